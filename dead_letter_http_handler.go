@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxDeadLettersPerRequest = 1000
+
+type DeadLetter struct {
+	DeviceID       string    `json:"deviceId"`
+	ContentType    string    `json:"contentType"`
+	Body           string    `json:"body"`
+	Category       string    `json:"category"`
+	Reason         string    `json:"reason"`
+	Retries        int       `json:"retries"`
+	DeadLetteredAt time.Time `json:"deadLetteredAt"`
+}
+
+type deadLetterStore interface {
+	DeadLetters(limit int) ([]DeadLetter, error)
+	ReplayDeadLetters(limit int) (int, error)
+}
+
+type deadLetterHTTPHandler struct {
+	store deadLetterStore
+}
+
+func (h *deadLetterHTTPHandler) getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit, err := h.getLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, "limit must be a number between 1 and 1000")
+		return
+	}
+
+	deadLetters, err := h.store.DeadLetters(limit)
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusInternalServerError, "failed to get dead letters")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(deadLetters); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *deadLetterHTTPHandler) replay(w http.ResponseWriter, r *http.Request) {
+	limit, err := h.getLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, "limit must be a number between 1 and 1000")
+		return
+	}
+
+	replayed, err := h.store.ReplayDeadLetters(limit)
+	if err != nil {
+		log.Printf("replayed %d dead letters before error: %v", replayed, err)
+		writeProblem(w, r, http.StatusInternalServerError, "failed to replay dead letters")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(struct {
+		Replayed int `json:"replayed"`
+	}{Replayed: replayed}); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *deadLetterHTTPHandler) getLimit(param string) (int, error) {
+	if param == "" {
+		return 100, nil
+	}
+
+	limit, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit < 1 || limit > maxDeadLettersPerRequest {
+		return 0, strconv.ErrRange
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetDeadLettersReturnsStoredMessages(t *testing.T) {
+	store := stubDeadLetterStore{deadLetters: []DeadLetter{{
+		DeviceID:       "5ff4a9b1e4b0a1a1a1a1a1a1",
+		ContentType:    "text/plain",
+		Body:           "not a number",
+		Category:       failureMalformedPayload,
+		Reason:         "strconv.ParseFloat: parsing \"not a number\": invalid syntax",
+		DeadLetteredAt: time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC),
+	}}}
+	req := httptest.NewRequest(http.MethodGet, "/admin/dead-letters?limit=10", nil)
+	res := httptest.NewRecorder()
+	underTest := deadLetterHTTPHandler{store: &store}
+
+	underTest.getDeadLetters(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, 10, store.limit)
+	require.JSONEq(t, `[{
+		"deviceId":"5ff4a9b1e4b0a1a1a1a1a1a1",
+		"contentType":"text/plain",
+		"body":"not a number",
+		"category":"malformed-payload",
+		"reason":"strconv.ParseFloat: parsing \"not a number\": invalid syntax",
+		"retries":0,
+		"deadLetteredAt":"2021-01-01T12:00:00Z"
+	}]`, res.Body.String())
+}
+
+func TestReplayDeadLettersReturnsReplayedCount(t *testing.T) {
+	store := stubDeadLetterStore{replayed: 3}
+	req := httptest.NewRequest(http.MethodPost, "/admin/dead-letters/replay", nil)
+	res := httptest.NewRecorder()
+	underTest := deadLetterHTTPHandler{store: &store}
+
+	underTest.replay(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, 100, store.limit)
+	require.JSONEq(t, `{"replayed":3}`, res.Body.String())
+}
+
+func TestDeadLettersBadLimit(t *testing.T) {
+	underTest := deadLetterHTTPHandler{store: &stubDeadLetterStore{}}
+
+	for _, limit := range []string{"0", "1001", "string"} {
+		t.Run(limit, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/dead-letters?limit="+limit, nil)
+			res := httptest.NewRecorder()
+
+			underTest.getDeadLetters(res, req)
+
+			assert.Equal(t, http.StatusBadRequest, res.Code)
+		})
+	}
+}
+
+func TestDeadLettersStoreError(t *testing.T) {
+	underTest := deadLetterHTTPHandler{store: &stubDeadLetterStore{err: errors.New("mock error - broker unavailable")}}
+
+	getRes := httptest.NewRecorder()
+	underTest.getDeadLetters(getRes, httptest.NewRequest(http.MethodGet, "/admin/dead-letters", nil))
+
+	replayRes := httptest.NewRecorder()
+	underTest.replay(replayRes, httptest.NewRequest(http.MethodPost, "/admin/dead-letters/replay", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, getRes.Code)
+	assert.Equal(t, http.StatusInternalServerError, replayRes.Code)
+}
+
+type stubDeadLetterStore struct {
+	deadLetters []DeadLetter
+	replayed    int
+	err         error
+	limit       int
+}
+
+func (s *stubDeadLetterStore) DeadLetters(limit int) ([]DeadLetter, error) {
+	s.limit = limit
+	return s.deadLetters, s.err
+}
+
+func (s *stubDeadLetterStore) ReplayDeadLetters(limit int) (int, error) {
+	s.limit = limit
+	return s.replayed, s.err
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	csvContentType    = "text/csv; charset=UTF-8"
+
+	exportFormatNDJSON = "ndjson"
+	exportFormatCSV    = "csv"
+
+	// exportFlushEvery is the number of exported devices after which the
+	// response is flushed, so clients start receiving a large export early.
+	exportFlushEvery = 100
+
+	// maxBulkBodyBytes bounds the import body, so a single huge device can't
+	// be read into memory.
+	maxBulkBodyBytes = 16 << 20
+)
+
+var (
+	errTooManyBulkDevices = fmt.Errorf("at most %d devices can be imported at once", maxBulkDevices)
+	errBulkBodyTooLarge   = fmt.Errorf("body can't be larger than %d bytes", maxBulkBodyBytes)
+)
+
+type bulkImportResponse struct {
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Results []BulkItemResult `json:"results"`
+}
+
+type bulkImportProblem struct {
+	Problem
+	Results []BulkItemResult `json:"results"`
+}
+
+func (h *deviceHTTPHandler) importDevices(w http.ResponseWriter, r *http.Request) {
+	atomic, err := h.getBool(r.URL.Query().Get("atomic"))
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, "atomic must be true or false")
+		return
+	}
+
+	items, err := h.decodeBulkItems(&bulkBody{Reader: http.MaxBytesReader(w, r.Body, maxBulkBodyBytes)}, r.Header.Get("Content-Type"))
+	if err != nil {
+		log.Print(err)
+		if errors.Is(err, errTooManyBulkDevices) || errors.Is(err, errBulkBodyTooLarge) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results := make([]BulkItemResult, len(items))
+	devices := make([]Device, 0, len(items))
+	indexes := make([]int, 0, len(items))
+	for i, item := range items {
+		var device Device
+		if err := json.Unmarshal(item, &device); err != nil {
+			results[i] = BulkItemResult{Index: i, Status: bulkStatusInvalid, Error: err.Error()}
+			continue
+		}
+
+		results[i] = BulkItemResult{Index: i, Status: bulkStatusSkipped}
+		devices = append(devices, device)
+		indexes = append(indexes, i)
+	}
+
+	if atomic && len(devices) < len(items) {
+		detail := fmt.Sprintf("%d of %d devices are invalid", len(items)-len(devices), len(items))
+		writeProblemBody(w, http.StatusBadRequest, bulkImportProblem{Problem: newProblem(r, http.StatusBadRequest, detail), Results: results})
+		return
+	}
+
+	created, err := h.service.CreateDevices(r.Context(), devices, atomic)
+	for i, result := range created {
+		result.Index = indexes[i]
+		results[indexes[i]] = result
+	}
+
+	if err != nil {
+		log.Print(err)
+		status, detail := errorStatus(err)
+		writeProblemBody(w, status, bulkImportProblem{Problem: newProblem(r, status, detail), Results: results})
+		return
+	}
+
+	response := bulkImportResponse{Results: results}
+	for _, result := range results {
+		if result.Status == bulkStatusCreated {
+			response.Created++
+		} else {
+			response.Failed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Print(err)
+	}
+}
+
+// decodeBulkItems reads devices from a JSON array or, when the content type
+// says so, from newline delimited JSON. Items are returned undecoded, so a
+// device with wrong field types is reported on its own.
+func (h *deviceHTTPHandler) decodeBulkItems(body io.Reader, contentType string) ([]json.RawMessage, error) {
+	decoder := json.NewDecoder(body)
+	var items []json.RawMessage
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == ndjsonContentType || mediaType == "application/ndjson" {
+		for {
+			var item json.RawMessage
+			if err := decoder.Decode(&item); err == io.EOF {
+				return items, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("invalid NDJSON at device %d: %w", len(items), err)
+			}
+
+			if items = append(items, item); len(items) > maxBulkDevices {
+				return nil, errTooManyBulkDevices
+			}
+		}
+	}
+
+	if token, err := decoder.Token(); errors.Is(err, errBulkBodyTooLarge) {
+		return nil, err
+	} else if err != nil || token != json.Delim('[') {
+		return nil, errors.New("body must be a JSON array of devices or NDJSON")
+	}
+
+	for decoder.More() {
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, fmt.Errorf("invalid JSON at device %d: %w", len(items), err)
+		}
+
+		if items = append(items, item); len(items) > maxBulkDevices {
+			return nil, errTooManyBulkDevices
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("invalid JSON array: %w", err)
+	}
+
+	return items, nil
+}
+
+// bulkBody tells reading past maxBulkBodyBytes apart from other read errors.
+// The limit itself is enforced by http.MaxBytesReader.
+type bulkBody struct {
+	io.Reader
+	read int64
+}
+
+func (b *bulkBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= maxBulkBodyBytes {
+		return n, errBulkBodyTooLarge
+	}
+
+	return n, err
+}
+
+// exportDevices streams all devices matching the filters of the request. The
+// response starts with the first device, so an error afterwards can only be
+// logged and cuts the export short.
+func (h *deviceHTTPHandler) exportDevices(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	format := params.Get("format")
+	if format == "" {
+		format = exportFormatNDJSON
+	}
+	if format != exportFormatNDJSON && format != exportFormatCSV {
+		writeProblem(w, r, http.StatusBadRequest, "format must be one of: ndjson, csv")
+		return
+	}
+
+	// export always goes through all matching devices
+	for _, param := range []string{"limit", "cursor"} {
+		if params.Get(param) != "" {
+			writeError(w, r, &ValidationError{Field: param, Reason: param + " is not supported by export, all matching devices are exported"})
+			return
+		}
+	}
+
+	query, err := h.getDeviceQuery(params)
+	if err != nil {
+		log.Print(err)
+		writeError(w, r, err)
+		return
+	}
+
+	exporter := newDeviceExporter(w, format)
+	exported := 0
+
+	err = h.service.ForEach(r.Context(), query, func(device Device) error {
+		if exported == 0 {
+			if err := exporter.start(); err != nil {
+				return err
+			}
+		}
+
+		if err := exporter.write(device); err != nil {
+			return err
+		}
+
+		if exported++; exported%exportFlushEvery == 0 {
+			exporter.flush()
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("export stopped after %d devices: %v", exported, err)
+		if exported == 0 {
+			writeError(w, r, err)
+		}
+		return
+	}
+
+	if exported == 0 {
+		if err := exporter.start(); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+	exporter.flush()
+}
+
+type deviceExporter struct {
+	w      http.ResponseWriter
+	format string
+	json   *json.Encoder
+	csv    *csv.Writer
+}
+
+func newDeviceExporter(w http.ResponseWriter, format string) *deviceExporter {
+	return &deviceExporter{w: w, format: format, json: json.NewEncoder(w), csv: csv.NewWriter(w)}
+}
+
+func (e *deviceExporter) start() error {
+	if e.format == exportFormatCSV {
+		e.w.Header().Set("Content-Type", csvContentType)
+		e.w.Header().Set("Content-Disposition", `attachment; filename="devices.csv"`)
+		e.w.WriteHeader(http.StatusOK)
+		return e.csv.Write([]string{"id", "name", "interval", "value", "unit", "description", "lat", "lon", "generator", "tags"})
+	}
+
+	e.w.Header().Set("Content-Type", ndjsonContentType)
+	e.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (e *deviceExporter) write(device Device) error {
+	if e.format != exportFormatCSV {
+		return e.json.Encode(device)
+	}
+
+	generator, err := jsonColumn(device.Generator, device.Generator == nil)
+	if err != nil {
+		return err
+	}
+
+	tags, err := jsonColumn(device.Tags, len(device.Tags) == 0)
+	if err != nil {
+		return err
+	}
+
+	var lat, lon string
+	if device.Location != nil {
+		lat = strconv.FormatFloat(device.Location.Lat, 'g', -1, 64)
+		lon = strconv.FormatFloat(device.Location.Lon, 'g', -1, 64)
+	}
+
+	return e.csv.Write([]string{
+		device.ID.Hex(),
+		device.Name,
+		device.Interval.Duration().String(),
+		strconv.FormatFloat(device.Value, 'g', -1, 64),
+		device.Unit,
+		device.Description,
+		lat,
+		lon,
+		generator,
+		tags,
+	})
+}
+
+func (e *deviceExporter) flush() {
+	e.csv.Flush()
+	if flusher, ok := e.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// jsonColumn writes nested values of a device as JSON in a single CSV column.
+func jsonColumn(v interface{}, empty bool) (string, error) {
+	if empty {
+		return "", nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportDevicesFromJSONArray(t *testing.T) {
+	dao := inMemoryDeviceDAO{}
+	id := primitive.NewObjectID()
+	body := fmt.Sprintf(`[{"id":"%v","name":"boiler","interval":"1s"},{"name":"","interval":"1s"},{"name":5}]`, id.Hex())
+	req := httptest.NewRequest(http.MethodPost, "/devices:bulk", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.importDevices(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, fmt.Sprintf(`{"created":1,"failed":2,"results":[
+		{"index":0,"status":"created","id":"%v"},
+		{"index":1,"status":"invalid","error":"device name can't be empty"},
+		{"index":2,"status":"invalid","error":"json: cannot unmarshal number into Go struct field Device.name of type string"}
+	]}`, id.Hex()), res.Body.String())
+	assert.Len(t, dao.devices, 1)
+}
+
+func TestImportDevicesFromNDJSON(t *testing.T) {
+	dao := inMemoryDeviceDAO{}
+	body := "{\"name\":\"boiler\",\"interval\":\"1s\"}\n{\"name\":\"pump\",\"interval\":\"2s\"}\n"
+	req := httptest.NewRequest(http.MethodPost, "/devices:bulk", strings.NewReader(body))
+	req.Header.Set("Content-Type", ndjsonContentType)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.importDevices(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"created":2`)
+	assert.Len(t, dao.devices, 2)
+}
+
+func TestImportDevicesAtomicWithInvalidDevice(t *testing.T) {
+	dao := inMemoryDeviceDAO{}
+	body := `[{"name":"boiler","interval":"1s"},{"name":"pump","interval":0}]`
+	req := httptest.NewRequest(http.MethodPost, "/devices:bulk?atomic=true", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.importDevices(res, req)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Equal(t, problemContentType, res.Header().Get("Content-Type"))
+	require.JSONEq(t, `{
+		"type":"about:blank",
+		"title":"Bad Request",
+		"status":400,
+		"detail":"1 of 2 devices are invalid",
+		"instance":"/devices:bulk",
+		"results":[
+			{"index":0,"status":"skipped"},
+			{"index":1,"status":"invalid","error":"interval has to be at least 1ms"}
+		]
+	}`, res.Body.String())
+	assert.Empty(t, dao.devices)
+}
+
+func TestImportDevicesRejectsBodyThatIsNotAnArray(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/devices:bulk", strings.NewReader(`{"name":"boiler"}`))
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	underTest.importDevices(res, req)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestImportDevicesRejectsTooLargeBody(t *testing.T) {
+	dao := inMemoryDeviceDAO{}
+	body := `[{"name":"` + strings.Repeat("a", maxBulkBodyBytes) + `","interval":"1s"}]`
+	req := httptest.NewRequest(http.MethodPost, "/devices:bulk", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.importDevices(res, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+	assert.Empty(t, dao.devices)
+}
+
+func TestExportDevicesAsNDJSON(t *testing.T) {
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID()}
+	dao := inMemoryDeviceDAO{devices: []Device{
+		{ID: ids[0], Name: "boiler", Interval: Interval(time.Second), Value: 1},
+		{ID: ids[1], Name: "pump", Interval: Interval(2 * time.Second), Value: 2},
+	}}
+	req := httptest.NewRequest(http.MethodGet, "/devices:export?name=pump", nil)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.exportDevices(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, ndjsonContentType, res.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprintf(`{"id":"%v","name":"pump","interval":"2s","value":2}`+"\n", ids[1].Hex()), res.Body.String())
+}
+
+func TestExportDevicesAsCSV(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{
+		{ID: id, Name: "boiler, north", Interval: Interval(1500 * time.Millisecond), Value: 1.5, Tags: map[string]string{"site": "krk"}, Unit: "°C", Location: &Location{Lat: 50.06, Lon: 19.94}},
+	}}
+	req := httptest.NewRequest(http.MethodGet, "/devices:export?format=csv", nil)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.exportDevices(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, csvContentType, res.Header().Get("Content-Type"))
+	assert.Equal(t, "id,name,interval,value,unit,description,lat,lon,generator,tags\n"+
+		id.Hex()+`,"boiler, north",1.5s,1.5,°C,,50.06,19.94,,"{""site"":""krk""}"`+"\n", res.Body.String())
+}
+
+func TestExportDevicesRejectsPagingParameters(t *testing.T) {
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	for _, query := range []string{"limit=10", "cursor=abc"} {
+		t.Run(query, func(t *testing.T) {
+			res := httptest.NewRecorder()
+
+			underTest.exportDevices(res, httptest.NewRequest(http.MethodGet, "/devices:export?"+query, nil))
+
+			assert.Equal(t, http.StatusBadRequest, res.Code)
+		})
+	}
+}
+
+func TestExportDevicesDatabaseError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/devices:export", nil)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &failingDeviceDAO{}}}
+
+	underTest.exportDevices(res, req)
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.Equal(t, problemContentType, res.Header().Get("Content-Type"))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	maxBulkDevices = 10000
+
+	// rollbackTimeout bounds deleting the devices of a failed atomic import.
+	rollbackTimeout = 30 * time.Second
+)
+
+const (
+	bulkStatusCreated    = "created"
+	bulkStatusInvalid    = "invalid"
+	bulkStatusFailed     = "failed"
+	bulkStatusRolledBack = "rolled-back"
+	bulkStatusSkipped    = "skipped"
+)
+
+// BulkItemResult tells what happened to a device at Index of a bulk import.
+type BulkItemResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CreateDevices creates the devices one by one. Without atomic every device
+// is created or rejected on its own, create observers are notified as for
+// single creates and the returned error is always nil.
+//
+// With atomic nothing is created unless all devices are valid, and when saving
+// fails half way the devices created so far are deleted again. Observers are
+// only notified once the whole batch is saved, so rolled back devices never
+// start publishing. The returned error then tells why the import was rejected.
+func (s *DeviceService) CreateDevices(ctx context.Context, devices []Device, atomic bool) ([]BulkItemResult, error) {
+	results := make([]BulkItemResult, len(devices))
+	for i := range results {
+		results[i] = BulkItemResult{Index: i, Status: bulkStatusSkipped}
+	}
+
+	if atomic {
+		invalid := 0
+		for i, device := range devices {
+			if err := s.validate(device); err != nil {
+				results[i].Status = bulkStatusInvalid
+				results[i].Error = err.Error()
+				invalid++
+			}
+		}
+
+		if invalid > 0 {
+			return results, &ValidationError{Field: "devices", Reason: fmt.Sprintf("%d of %d devices are invalid", invalid, len(devices))}
+		}
+	}
+
+	saved := make([]Device, 0, len(devices))
+	for i, device := range devices {
+		created, err := s.saveDevice(ctx, device)
+		if err != nil {
+			results[i].Status = bulkStatusFailed
+			if errors.Is(err, ErrValidation) {
+				results[i].Status = bulkStatusInvalid
+			}
+			results[i].Error = err.Error()
+
+			if atomic {
+				s.rollback(results[:i])
+				return results, err
+			}
+			continue
+		}
+
+		results[i].Status = bulkStatusCreated
+		results[i].ID = created.ID.Hex()
+
+		if atomic {
+			saved = append(saved, created)
+		} else {
+			s.notifyCreated(created)
+		}
+	}
+
+	for _, device := range saved {
+		s.notifyCreated(device)
+	}
+
+	return results, nil
+}
+
+// rollback deletes the created devices on its own context, a failure is often
+// caused by the client going away, which cancels the request context.
+func (s *DeviceService) rollback(results []BulkItemResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	for i := range results {
+		if results[i].Status != bulkStatusCreated {
+			continue
+		}
+
+		if err := s.removeDevice(ctx, results[i].ID, 0); err != nil {
+			log.Printf("failed to roll back device %v: %v", results[i].ID, err)
+			results[i].Error = fmt.Sprintf("rollback failed: %v", err)
+			continue
+		}
+
+		results[i].Status = bulkStatusRolledBack
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestCreateDevicesReportsEachDevice(t *testing.T) {
+	dao := inMemoryDeviceDAO{}
+	observer := bulkObserver{}
+	underTest := DeviceService{dao: &dao}
+	underTest.AddObserver(&observer)
+
+	results, err := underTest.CreateDevices(context.Background(), []Device{
+		{ID: primitive.NewObjectID(), Name: "first", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "third", Interval: Interval(time.Second)},
+	}, false)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{bulkStatusCreated, bulkStatusInvalid, bulkStatusCreated}, bulkStatuses(results))
+	assert.Equal(t, validationEmptyDeviceNameErr, results[1].Error)
+	assert.Len(t, dao.devices, 2)
+	assert.Equal(t, 2, observer.created)
+}
+
+func TestCreateDevicesAtomicRejectsAllWhenOneIsInvalid(t *testing.T) {
+	dao := inMemoryDeviceDAO{}
+	underTest := DeviceService{dao: &dao}
+
+	results, err := underTest.CreateDevices(context.Background(), []Device{
+		{ID: primitive.NewObjectID(), Name: "first", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "second"},
+	}, true)
+
+	assert.True(t, errors.Is(err, ErrValidation))
+	assert.Equal(t, []string{bulkStatusSkipped, bulkStatusInvalid}, bulkStatuses(results))
+	assert.Empty(t, dao.devices)
+}
+
+func TestCreateDevicesAtomicRollsBackWhenSaveFails(t *testing.T) {
+	dao := failingAfterDeviceDAO{saves: 2}
+	observer := bulkObserver{}
+	underTest := DeviceService{dao: &dao}
+	underTest.AddObserver(&observer)
+	underTest.AddDeleteObserver(&observer)
+
+	results, err := underTest.CreateDevices(context.Background(), []Device{
+		{ID: primitive.NewObjectID(), Name: "first", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "second", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "third", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "fourth", Interval: Interval(time.Second)},
+	}, true)
+
+	assert.True(t, errors.Is(err, ErrStorage))
+	assert.Equal(t, []string{bulkStatusRolledBack, bulkStatusRolledBack, bulkStatusFailed, bulkStatusSkipped}, bulkStatuses(results))
+	assert.Empty(t, dao.devices)
+	assert.Zero(t, observer.created, "rolled back devices should not start publishing")
+	assert.Zero(t, observer.deleted)
+}
+
+func TestCreateDevicesAtomicRollsBackAfterClientDisconnect(t *testing.T) {
+	dao := failingAfterDeviceDAO{saves: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	underTest := DeviceService{dao: &dao}
+
+	results, err := underTest.CreateDevices(ctx, []Device{
+		{ID: primitive.NewObjectID(), Name: "first", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "second", Interval: Interval(time.Second)},
+	}, true)
+
+	assert.True(t, errors.Is(err, ErrStorage))
+	assert.Equal(t, []string{bulkStatusRolledBack, bulkStatusFailed}, bulkStatuses(results))
+	assert.Empty(t, dao.devices)
+}
+
+func TestCreateDevicesAtomicNotifiesObserversOnceAllAreSaved(t *testing.T) {
+	dao := inMemoryDeviceDAO{}
+	observer := bulkObserver{dao: &dao}
+	underTest := DeviceService{dao: &dao}
+	underTest.AddObserver(&observer)
+
+	_, err := underTest.CreateDevices(context.Background(), []Device{
+		{ID: primitive.NewObjectID(), Name: "first", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "second", Interval: Interval(time.Second)},
+	}, true)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, observer.created)
+	assert.Equal(t, []int{2, 2}, observer.savedWhenNotified)
+}
+
+// failingAfterDeviceDAO saves the given number of devices and fails afterwards.
+type failingAfterDeviceDAO struct {
+	inMemoryDeviceDAO
+	saves int
+}
+
+func (db *failingAfterDeviceDAO) Save(ctx context.Context, device Device) (Device, error) {
+	if db.saves == 0 {
+		return device, errors.New("mock error - failed to create device")
+	}
+
+	db.saves--
+	return db.inMemoryDeviceDAO.Save(ctx, device)
+}
+
+// Delete fails on a done context, like the Mongo driver does.
+func (db *failingAfterDeviceDAO) Delete(ctx context.Context, id string, ifVersion int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return db.inMemoryDeviceDAO.Delete(ctx, id, ifVersion)
+}
+
+type bulkObserver struct {
+	created int
+	deleted int
+	// savedWhenNotified records the number of devices in dao at each create
+	// notification, when dao is set.
+	dao               *inMemoryDeviceDAO
+	savedWhenNotified []int
+}
+
+func (o *bulkObserver) NotifyDeviceCreated(_ Device) {
+	o.created++
+	if o.dao != nil {
+		o.savedWhenNotified = append(o.savedWhenNotified, len(o.dao.devices))
+	}
+}
+
+func (o *bulkObserver) NotifyDeviceDeleted(_ string) {
+	o.deleted++
+}
+
+func bulkStatuses(results []BulkItemResult) []string {
+	statuses := make([]string, len(results))
+	for i, result := range results {
+		statuses[i] = result.Status
+	}
+	return statuses
+}
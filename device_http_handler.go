@@ -2,15 +2,29 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// maxPatchAttempts bounds how often a patch without If-Match is merged again
+// after losing a race with another write.
+const maxPatchAttempts = 3
+
+type deviceStatusProvider interface {
+	DeviceStatus(id string) string
+}
+
 type deviceHTTPHandler struct {
 	service *DeviceService
+	status  deviceStatusProvider
 }
 
 func (h *deviceHTTPHandler) createDevice(w http.ResponseWriter, r *http.Request) {
@@ -18,29 +32,24 @@ func (h *deviceHTTPHandler) createDevice(w http.ResponseWriter, r *http.Request)
 
 	if err := json.NewDecoder(r.Body).Decode(&requestDevice); err != nil {
 		log.Print(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	createdDevice, err := h.service.CreateDevice(r.Context(), requestDevice)
 	if err != nil {
 		log.Print(err)
-		switch err.Error() {
-		case validationEmptyDeviceNameErr, validationWrongIntervalErr:
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		case daoSaveErr:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		default:
-			//3BJO_TODO: Programming error. panic("not handled status") or log.Fatal("not handled status")
-		}
+		writeError(w, r, err)
 		return
 	}
 
+	h.withStatus(&createdDevice)
+	setETag(w, &createdDevice)
+
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(createdDevice); err != nil {
 		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -50,59 +59,312 @@ func (h *deviceHTTPHandler) getByID(w http.ResponseWriter, r *http.Request) {
 	device, err := h.service.GetByID(r.Context(), id)
 	if err != nil {
 		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	if device == nil {
-		w.WriteHeader(http.StatusNotFound)
-		if err := json.NewEncoder(w).Encode(fmt.Sprintf("device with id %v not found", id)); err != nil {
-			log.Print(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
-	}
+	h.withStatus(device)
+	setETag(w, device)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(device); err != nil {
 		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 func (h *deviceHTTPHandler) getAll(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
+	query, err := h.getDeviceQuery(r.URL.Query())
+	if err != nil {
+		log.Print(err)
+		writeError(w, r, err)
+		return
+	}
 
-	limit, err := h.getValueOrDefault(params.Get("limit"), 100)
-	if err != nil || limit < 0 {
+	page, err := h.service.GetAll(r.Context(), query)
+	if err != nil {
 		log.Print(err)
-		http.Error(w, "limit must be a number greater or equal to 0", http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	page, err := h.getValueOrDefault(params.Get("page"), 0)
-	if err != nil || page < 0 {
+	for i := range page.Devices {
+		h.withStatus(&page.Devices[i])
+	}
+
+	if page.NextCursor != "" {
+		w.Header().Set("Link", fmt.Sprintf(`<%v>; rel="next"`, h.nextPageURL(r.URL, page.NextCursor)))
+	}
+	if page.Total != nil {
+		w.Header().Set("X-Total-Count", strconv.FormatInt(*page.Total, 10))
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page.Devices); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *deviceHTTPHandler) updateDevice(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var requestDevice Device
+	if err := json.NewDecoder(r.Body).Decode(&requestDevice); err != nil {
 		log.Print(err)
-		http.Error(w, "page must be a number greater or equal to 0", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	devices, err := h.service.GetAll(r.Context(), limit, page)
+	ifVersion, err := ifMatchVersion(r)
 	if err != nil {
 		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusPreconditionFailed, err.Error())
 		return
 	}
 
+	h.update(w, r, id, requestDevice, ifVersion)
+}
+
+// patchDevice merges the body into the stored device and writes it back only
+// if the device is still in the version that was read, so concurrent patches
+// aren't lost. Without If-Match a patch that lost the race is merged again
+// into the newer version, up to maxPatchAttempts times.
+func (h *deviceHTTPHandler) patchDevice(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		device, err := h.service.GetByID(r.Context(), id)
+		if err != nil {
+			log.Print(err)
+			writeError(w, r, err)
+			return
+		}
+
+		readVersion := device.Version
+		if ifVersion > 0 && readVersion != ifVersion {
+			err := &VersionMismatchError{Resource: "device", ID: id, Expected: ifVersion, Actual: readVersion}
+			log.Print(err)
+			writeError(w, r, err)
+			return
+		}
+
+		if err := json.Unmarshal(body, device); err != nil {
+			log.Print(err)
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		updatedDevice, err := h.service.UpdateDevice(r.Context(), id, *device, readVersion)
+		if err != nil {
+			log.Print(err)
+			if ifVersion == 0 && attempt < maxPatchAttempts && errors.Is(err, ErrPreconditionFailed) {
+				continue
+			}
+			writeError(w, r, err)
+			return
+		}
+
+		h.writeUpdated(w, updatedDevice)
+		return
+	}
+}
+
+func (h *deviceHTTPHandler) update(w http.ResponseWriter, r *http.Request, id string, device Device, ifVersion int64) {
+	updatedDevice, err := h.service.UpdateDevice(r.Context(), id, device, ifVersion)
+	if err != nil {
+		log.Print(err)
+		writeError(w, r, err)
+		return
+	}
+
+	h.writeUpdated(w, updatedDevice)
+}
+
+func (h *deviceHTTPHandler) writeUpdated(w http.ResponseWriter, updatedDevice *Device) {
+	h.withStatus(updatedDevice)
+	setETag(w, updatedDevice)
+
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(devices); err != nil {
+	if err := json.NewEncoder(w).Encode(updatedDevice); err != nil {
 		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+func (h *deviceHTTPHandler) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+
+	if err := h.service.DeleteDevice(r.Context(), id, ifVersion); err != nil {
+		log.Print(err)
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *deviceHTTPHandler) withStatus(device *Device) {
+	if h.status != nil {
+		device.Status = h.status.DeviceStatus(device.ID.Hex())
+	}
+}
+
+// setETag exposes the device version, so clients can send it back in
+// If-Match to update or delete only the version they have seen.
+func setETag(w http.ResponseWriter, device *Device) {
+	if device.Version > 0 {
+		w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(device.Version, 10)))
+	}
+}
+
+// ifMatchVersion returns the device version required by the If-Match header,
+// 0 when the header is missing or is "*". If-Match uses strong comparison, so
+// weak ETags never match.
+func ifMatchVersion(r *http.Request) (int64, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, nil
+	}
+
+	if len(ifMatch) < 2 || ifMatch[0] != '"' || ifMatch[len(ifMatch)-1] != '"' {
+		return 0, fmt.Errorf("If-Match must be a single strong ETag returned for the device, got %v", ifMatch)
+	}
+
+	version, err := strconv.ParseInt(ifMatch[1:len(ifMatch)-1], 10, 64)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("If-Match must be a single ETag returned for the device, got %v", ifMatch)
+	}
+
+	return version, nil
+}
+
+func (h *deviceHTTPHandler) getDeviceQuery(params url.Values) (DeviceQuery, error) {
+	query := DeviceQuery{
+		Name:      params.Get("name"),
+		NameRegex: params.Get("nameRegex"),
+		Sort:      params.Get("sort"),
+		Cursor:    params.Get("cursor"),
+		Unit:      params.Get("unit"),
+	}
+
+	var err error
+	if query.Limit, err = h.getValueOrDefault(params.Get("limit"), 100); err != nil || query.Limit < 1 || query.Limit > maxDevicesPerPage {
+		return query, &ValidationError{Field: "limit", Reason: fmt.Sprintf("limit must be a number between 1 and %d", maxDevicesPerPage)}
+	}
+
+	if params.Get("page") != "" {
+		return query, &ValidationError{Field: "page", Reason: "page is not supported, follow the cursor from the next link instead"}
+	}
+
+	if query.IncludeTotal, err = h.getBool(params.Get("total")); err != nil {
+		return query, &ValidationError{Field: "total", Reason: "total must be true or false"}
+	}
+
+	if query.MinInterval, err = h.getInterval(params.Get("minInterval")); err != nil {
+		return query, &ValidationError{Field: "minInterval", Reason: "minInterval must be a positive duration, e.g. 500ms or 1m"}
+	}
+
+	if query.MaxInterval, err = h.getInterval(params.Get("maxInterval")); err != nil {
+		return query, &ValidationError{Field: "maxInterval", Reason: "maxInterval must be a positive duration, e.g. 500ms or 1m"}
+	}
+
+	if query.MinValue, err = h.getFloat(params.Get("minValue")); err != nil {
+		return query, &ValidationError{Field: "minValue", Reason: "minValue must be a number"}
+	}
+
+	if query.MaxValue, err = h.getFloat(params.Get("maxValue")); err != nil {
+		return query, &ValidationError{Field: "maxValue", Reason: "maxValue must be a number"}
+	}
+
+	for _, tag := range params["tag"] {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return query, &ValidationError{Field: "tag", Reason: "tag must be in key:value format"}
+		}
+
+		if err := validateTagKey(kv[0]); err != nil {
+			return query, &ValidationError{Field: "tag", Reason: fmt.Sprintf("%v %q: %v", validationWrongTagErr, kv[0], err)}
+		}
+
+		if query.Tags == nil {
+			query.Tags = make(map[string]string)
+		}
+		query.Tags[kv[0]] = kv[1]
+	}
+
+	return query, nil
+}
+
+// nextPageURL keeps the filters of the current request and replaces its
+// cursor, so following the link returns the next page of the same listing.
+func (h *deviceHTTPHandler) nextPageURL(current *url.URL, cursor string) string {
+	params := current.Query()
+	params.Set("cursor", cursor)
+
+	next := url.URL{Path: current.Path, RawQuery: params.Encode()}
+	return next.String()
+}
+
+func (h *deviceHTTPHandler) getBool(param string) (bool, error) {
+	if param == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(param)
+}
+
+func (h *deviceHTTPHandler) getInterval(param string) (Interval, error) {
+	if param == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(param)
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, strconv.ErrRange
+	}
+
+	return Interval(d), nil
+}
+
+func (h *deviceHTTPHandler) getFloat(param string) (*float64, error) {
+	if param == "" {
+		return nil, nil
+	}
+
+	f, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
 func (h *deviceHTTPHandler) getValueOrDefault(param string, defVal int) (int, error) {
 	if param == "" {
 		return defVal, nil
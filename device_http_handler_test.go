@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
@@ -12,11 +13,76 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestCreateValidDeviceWithNoDatabaseErrors(t *testing.T) {
 	id := primitive.NewObjectID()
-	body := strings.NewReader(fmt.Sprintf(`{"id":"%v","name":"test name2","interval":1}`, id.Hex()))
+	body := strings.NewReader(fmt.Sprintf(`{"id":"%v","name":"test name2","interval":"1s"}`, id.Hex()))
+	req := httptest.NewRequest(http.MethodPost, "/devices", body)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{clock: fixedClock}}}
+
+	underTest.createDevice(res, req)
+
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, `"1"`, res.Header().Get("ETag"))
+	require.JSONEq(t, fmt.Sprintf(`{
+		"id":"%v",
+		"name":"test name2",
+		"interval":"1s",
+		"value":0,
+		"createdAt":"2021-01-01T12:00:00Z",
+		"updatedAt":"2021-01-01T12:00:00Z",
+		"version":1
+	}`, id.Hex()), res.Body.String())
+}
+
+func TestCreateDeviceWithMetadata(t *testing.T) {
+	id := primitive.NewObjectID()
+	device := fmt.Sprintf(`{
+		"id":"%v",
+		"name":"boiler",
+		"interval":"1s",
+		"value":0,
+		"tags":{"site":"krk","type":"boiler"},
+		"unit":"°C",
+		"description":"boiler room, north wall",
+		"location":{"lat":50.06,"lon":19.94},
+		"createdAt":"2021-01-01T12:00:00Z",
+		"updatedAt":"2021-01-01T12:00:00Z",
+		"version":1
+	}`, id.Hex())
+	req := httptest.NewRequest(http.MethodPost, "/devices", strings.NewReader(device))
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{clock: fixedClock}}}
+
+	underTest.createDevice(res, req)
+
+	assert.Equal(t, http.StatusCreated, res.Code)
+	require.JSONEq(t, device, res.Body.String())
+}
+
+func TestCreateDeviceWithDuplicateName(t *testing.T) {
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: primitive.NewObjectID(), Name: "boiler", Interval: Interval(time.Second)}}}
+	req := httptest.NewRequest(http.MethodPost, "/devices", strings.NewReader(`{"name":"boiler","interval":"1s"}`))
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.createDevice(res, req)
+
+	assert.Equal(t, http.StatusConflict, res.Code)
+	require.JSONEq(t, `{
+		"type":"about:blank",
+		"title":"Conflict",
+		"status":409,
+		"detail":"device with name \"boiler\" already exists",
+		"instance":"/devices"
+	}`, res.Body.String())
+}
+
+func TestCreateDeviceWithSubSecondInterval(t *testing.T) {
+	body := strings.NewReader(`{"name":"fast","interval":"250ms"}`)
 	req := httptest.NewRequest(http.MethodPost, "/devices", body)
 	res := httptest.NewRecorder()
 	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
@@ -24,7 +90,7 @@ func TestCreateValidDeviceWithNoDatabaseErrors(t *testing.T) {
 	underTest.createDevice(res, req)
 
 	assert.Equal(t, http.StatusCreated, res.Code)
-	require.JSONEq(t, fmt.Sprintf(`{"id":"%v","name":"test name2","interval":1,"value":0}`, id.Hex()), res.Body.String())
+	assert.Contains(t, res.Body.String(), `"interval":"250ms"`)
 }
 
 func TestCreateInvalidDevice(t *testing.T) {
@@ -35,11 +101,29 @@ func TestCreateInvalidDevice(t *testing.T) {
 
 	underTest.createDevice(res, req)
 
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	require.JSONEq(t, `{
+		"type":"about:blank",
+		"title":"Bad Request",
+		"status":400,
+		"detail":"interval has to be at least 1ms",
+		"instance":"/devices"
+	}`, res.Body.String())
+}
+
+func TestCreateDeviceWithInvalidGenerator(t *testing.T) {
+	body := strings.NewReader(`{"name":"test name2","interval":"1s","generator":{"type":"uniform","params":{"min":2,"max":1}}}`)
+	req := httptest.NewRequest(http.MethodPost, "/devices", body)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	underTest.createDevice(res, req)
+
 	assert.Equal(t, http.StatusBadRequest, res.Code)
 }
 
 func TestCreateValidDeviceButErrorWhenSaveInDatabase(t *testing.T) {
-	body := strings.NewReader(`{"name":"test name2","interval":1}`)
+	body := strings.NewReader(`{"name":"test name2","interval":"1s"}`)
 	req := httptest.NewRequest(http.MethodPost, "/devices", body)
 	res := httptest.NewRecorder()
 	underTest := deviceHTTPHandler{service: &DeviceService{dao: &failingDeviceDAO{}}}
@@ -47,6 +131,8 @@ func TestCreateValidDeviceButErrorWhenSaveInDatabase(t *testing.T) {
 	underTest.createDevice(res, req)
 
 	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.Equal(t, problemContentType, res.Header().Get("Content-Type"))
+	assert.Contains(t, res.Body.String(), `"detail":"failed to save device"`)
 }
 
 func TestGetByIDDatabaseError(t *testing.T) {
@@ -59,29 +145,76 @@ func TestGetByIDDatabaseError(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, res.Code)
 }
 
+func TestGetByIDInvalidID(t *testing.T) {
+	req := createGetDeviceRequest("garbage")
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	underTest.getByID(res, req)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), `"detail":"invalid id \"garbage\": must be a 24 character hex string"`)
+}
+
 func TestGetByIdDeviceNotFound(t *testing.T) {
-	req := createGetDeviceRequest("0")
+	req := createGetDeviceRequest("5ff4a9b1e4b0a1a1a1a1a1a1")
 	res := httptest.NewRecorder()
 	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
 
 	underTest.getByID(res, req)
 
 	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Equal(t, problemContentType, res.Header().Get("Content-Type"))
+	require.JSONEq(t, `{
+		"type":"about:blank",
+		"title":"Not Found",
+		"status":404,
+		"detail":"device with id 5ff4a9b1e4b0a1a1a1a1a1a1 not found",
+		"instance":"/devices"
+	}`, res.Body.String())
 }
 
 func TestGetByIDDeviceExists(t *testing.T) {
 	id := primitive.NewObjectID()
 	req := createGetDeviceRequest(id.Hex())
 	res := httptest.NewRecorder()
-	device := Device{ID: id, Name: "device", Interval: 1, Value: 1}
-	dao := inMemoryDeviceDAO{}
+	device := Device{ID: id, Name: "device", Interval: Interval(time.Second), Value: 1}
+	dao := inMemoryDeviceDAO{clock: fixedClock}
 	_, _ = dao.Save(context.Background(), device)
 	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
 
 	underTest.getByID(res, req)
 
 	assert.Equal(t, http.StatusOK, res.Code)
-	require.JSONEq(t, fmt.Sprintf(`{"id":"%v","name":"device","interval":1,"value":1}`, id.Hex()), res.Body.String())
+	assert.Equal(t, `"1"`, res.Header().Get("ETag"))
+	require.JSONEq(t, fmt.Sprintf(`{
+		"id":"%v",
+		"name":"device",
+		"interval":"1s",
+		"value":1,
+		"createdAt":"2021-01-01T12:00:00Z",
+		"updatedAt":"2021-01-01T12:00:00Z",
+		"version":1
+	}`, id.Hex()), res.Body.String())
+}
+
+func TestGetByIDIncludesTickerStatus(t *testing.T) {
+	id := primitive.NewObjectID()
+	req := createGetDeviceRequest(id.Hex())
+	res := httptest.NewRecorder()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "device", Interval: Interval(time.Second), Value: 1}}}
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}, status: stubDeviceStatus(deviceStatusPaused)}
+
+	underTest.getByID(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, fmt.Sprintf(`{"id":"%v","name":"device","interval":"1s","value":1,"status":"paused"}`, id.Hex()), res.Body.String())
+}
+
+type stubDeviceStatus string
+
+func (s stubDeviceStatus) DeviceStatus(_ string) string {
+	return string(s)
 }
 
 func createGetDeviceRequest(id string) *http.Request {
@@ -94,8 +227,15 @@ func createGetDeviceRequest(id string) *http.Request {
 
 func TestGetAllBadRequestParameters(t *testing.T) {
 	testCases := map[string][]string{
-		"page":  {"-1", "string"},
-		"limit": {"-1", "string"},
+		"page":        {"0", "1"},
+		"limit":       {"-1", "0", "1001", "string"},
+		"cursor":      {"not a cursor"},
+		"total":       {"maybe"},
+		"minInterval": {"-1s", "string"},
+		"maxValue":    {"string"},
+		"nameRegex":   {"("},
+		"sort":        {"id", "+name"},
+		"tag":         {"site", ":krk", "site.room:1", "$where:1", "deviceId:x"},
 	}
 
 	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
@@ -117,6 +257,26 @@ func TestGetAllBadRequestParameters(t *testing.T) {
 	}
 }
 
+func TestGetAllFiltersAndSortsDevices(t *testing.T) {
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+	dao := inMemoryDeviceDAO{devices: []Device{
+		{ID: ids[0], Name: "boiler a", Interval: Interval(time.Second), Value: 1, Tags: map[string]string{"site": "krk"}},
+		{ID: ids[1], Name: "boiler b", Interval: Interval(2 * time.Second), Value: 2, Tags: map[string]string{"site": "krk"}},
+		{ID: ids[2], Name: "pump", Interval: Interval(3 * time.Second), Value: 3, Tags: map[string]string{"site": "krk"}},
+	}}
+	req := httptest.NewRequest(http.MethodGet, "/devices?name=Boiler&minInterval=500ms&maxValue=10&tag=site:krk&sort=-interval", nil)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.getAll(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, fmt.Sprintf(`[
+		{"id":"%v","name":"boiler b","interval":"2s","value":2,"tags":{"site":"krk"}},
+		{"id":"%v","name":"boiler a","interval":"1s","value":1,"tags":{"site":"krk"}}
+	]`, ids[1].Hex(), ids[0].Hex()), res.Body.String())
+}
+
 func TestGetAllDatabaseError(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/devices", nil)
 	res := httptest.NewRecorder()
@@ -140,29 +300,407 @@ func TestGetAllNoDevicesReturnEmptyList(t *testing.T) {
 	require.JSONEq(t, "[]", res.Body.String())
 }
 
-func TestGetAllReturnRequestedDevices(t *testing.T) {
-	devices := []Device{
-		{Name: "device 1", Interval: 1, Value: 11},
-		{Name: "device 2", Interval: 2, Value: 12},
-		{Name: "device 3", Interval: 3, Value: 13},
-		{Name: "device 4", Interval: 4, Value: 14},
-		{Name: "device 5", Interval: 5, Value: 15},
+func TestGetAllFollowsNextLinkThroughPages(t *testing.T) {
+	var devices []Device
+	for i := 1; i <= 5; i++ {
+		devices = append(devices, Device{ID: primitive.NewObjectID(), Name: fmt.Sprintf("device %d", i), Interval: Interval(time.Second), Value: float64(i)})
 	}
-	dao := inMemoryDeviceDAO{devices: append([]Device(nil), devices...)}
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{devices: devices}}}
+
+	var pages [][]string
+	target := "/devices?limit=2&sort=name"
+	for target != "" {
+		res := httptest.NewRecorder()
+		underTest.getAll(res, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusOK, res.Code)
+
+		var page []Device
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &page))
+		var names []string
+		for _, device := range page {
+			names = append(names, device.Name)
+		}
+		pages = append(pages, names)
 
-	req := httptest.NewRequest(http.MethodGet, "/devices", nil)
-	query := req.URL.Query()
-	query.Add("limit", "2")
-	query.Add("page", "1")
-	req.URL.RawQuery = query.Encode()
-	res := httptest.NewRecorder()
+		target = ""
+		if link := res.Header().Get("Link"); link != "" {
+			require.Regexp(t, `^<(/devices\?[^>]+)>; rel="next"$`, link)
+			target = link[1:strings.Index(link, ">")]
+			assert.Contains(t, target, "sort=name")
+		}
+	}
 
+	assert.Equal(t, [][]string{{"device 1", "device 2"}, {"device 3", "device 4"}, {"device 5"}}, pages)
+}
+
+func TestGetAllWithTotalCount(t *testing.T) {
+	dao := inMemoryDeviceDAO{devices: []Device{
+		{ID: primitive.NewObjectID(), Name: "boiler", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "pump", Interval: Interval(time.Second)},
+		{ID: primitive.NewObjectID(), Name: "boiler 2", Interval: Interval(time.Second)},
+	}}
+	req := httptest.NewRequest(http.MethodGet, "/devices?limit=1&name=boiler&total=true", nil)
+	res := httptest.NewRecorder()
 	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
 
 	underTest.getAll(res, req)
 
 	assert.Equal(t, http.StatusOK, res.Code)
-	require.JSONEq(t, fmt.Sprintf(`[{"id":"%[1]v","name":"device 3","interval":3,"value":13},{"id":"%[1]v","name":"device 4","interval":4,"value":14}]`, primitive.NilObjectID.Hex()), res.Body.String())
+	assert.Equal(t, "2", res.Header().Get("X-Total-Count"))
+	assert.NotEmpty(t, res.Header().Get("Link"))
+}
+
+func TestGetAllRejectsCursorOfDifferentSort(t *testing.T) {
+	cursor := newDeviceCursor(Device{ID: primitive.NewObjectID(), Name: "device"}, "name").encode()
+	req := httptest.NewRequest(http.MethodGet, "/devices?sort=-interval&cursor="+cursor, nil)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	underTest.getAll(res, req)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestUpdateDeviceReplacesAllFields(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 1)}, clock: fixedClock}
+	req := createDeviceRequest(http.MethodPut, id.Hex(), `{"name":"updated","interval":"2s","value":3,"version":7}`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.updateDevice(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `"2"`, res.Header().Get("ETag"))
+	require.JSONEq(t, fmt.Sprintf(`{
+		"id":"%v",
+		"name":"updated",
+		"interval":"2s",
+		"value":3,
+		"createdAt":"2020-12-31T12:00:00Z",
+		"updatedAt":"2021-01-01T12:00:00Z",
+		"version":2
+	}`, id.Hex()), res.Body.String())
+}
+
+func TestUpdateDeviceWithMatchingIfMatch(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 3)}}
+	req := createDeviceRequest(http.MethodPut, id.Hex(), `{"name":"updated","interval":"2s"}`)
+	req.Header.Set("If-Match", `"3"`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.updateDevice(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `"4"`, res.Header().Get("ETag"))
+	assert.Equal(t, int64(4), dao.devices[0].Version)
+}
+
+func TestUpdateDeviceWithStaleIfMatch(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 3)}}
+	req := createDeviceRequest(http.MethodPut, id.Hex(), `{"name":"updated","interval":"2s"}`)
+	req.Header.Set("If-Match", `"2"`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.updateDevice(res, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+	assert.Equal(t, "device", dao.devices[0].Name)
+	require.JSONEq(t, fmt.Sprintf(`{
+		"type":"about:blank",
+		"title":"Precondition Failed",
+		"status":412,
+		"detail":"device with id %[1]v has version 3, not 2",
+		"instance":"/devices/%[1]v"
+	}`, id.Hex()), res.Body.String())
+}
+
+func TestUpdateDeviceWithMalformedIfMatch(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 3)}}
+	req := createDeviceRequest(http.MethodPut, id.Hex(), `{"name":"updated","interval":"2s"}`)
+	req.Header.Set("If-Match", `"abc"`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.updateDevice(res, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+	assert.Equal(t, int64(3), dao.devices[0].Version)
+}
+
+func TestUpdateDeviceWithInvalidData(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "device", Interval: Interval(time.Second), Value: 1}}}
+	req := createDeviceRequest(http.MethodPut, id.Hex(), `{"name":"updated","interval":0}`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.updateDevice(res, req)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestUpdateDeviceNotFound(t *testing.T) {
+	req := createDeviceRequest(http.MethodPut, primitive.NewObjectID().Hex(), `{"name":"updated","interval":"1s"}`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	underTest.updateDevice(res, req)
+
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestUpdateDeviceDatabaseError(t *testing.T) {
+	req := createDeviceRequest(http.MethodPut, primitive.NewObjectID().Hex(), `{"name":"updated","interval":"1s"}`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &failingDeviceDAO{}}}
+
+	underTest.updateDevice(res, req)
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+}
+
+func TestPatchDeviceKeepsFieldsNotInBody(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 1)}, clock: fixedClock}
+	req := createDeviceRequest(http.MethodPatch, id.Hex(), `{"value":7}`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.patchDevice(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, fmt.Sprintf(`{
+		"id":"%v",
+		"name":"device",
+		"interval":"1s",
+		"value":7,
+		"createdAt":"2020-12-31T12:00:00Z",
+		"updatedAt":"2021-01-01T12:00:00Z",
+		"version":2
+	}`, id.Hex()), res.Body.String())
+}
+
+func TestPatchDeviceWithStaleIfMatch(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 3)}}
+	req := createDeviceRequest(http.MethodPatch, id.Hex(), `{"value":7}`)
+	req.Header.Set("If-Match", `"2"`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.patchDevice(res, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+	assert.Equal(t, float64(1), dao.devices[0].Value)
+}
+
+func TestPatchDeviceWithWeakIfMatch(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 3)}}
+	req := createDeviceRequest(http.MethodPatch, id.Hex(), `{"value":7}`)
+	req.Header.Set("If-Match", `W/"3"`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.patchDevice(res, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+	assert.Equal(t, int64(3), dao.devices[0].Version)
+}
+
+func TestPatchDeviceMergesAgainAfterConcurrentUpdate(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := racingDeviceDAO{inMemoryDeviceDAO: inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 1)}}, races: 1}
+	req := createDeviceRequest(http.MethodPatch, id.Hex(), `{"value":7}`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.patchDevice(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "racer", dao.devices[0].Name)
+	assert.Equal(t, float64(7), dao.devices[0].Value)
+	assert.Equal(t, int64(3), dao.devices[0].Version)
+}
+
+func TestPatchDeviceWithIfMatchFailsAfterConcurrentUpdate(t *testing.T) {
+	id := primitive.NewObjectID()
+	device := newVersionedDevice(id, 1)
+	device.Tags = map[string]string{"site": "krk"}
+	dao := racingDeviceDAO{inMemoryDeviceDAO: inMemoryDeviceDAO{devices: []Device{device}}, races: 1}
+	req := createDeviceRequest(http.MethodPatch, id.Hex(), `{"value":7,"tags":{"site":"waw"}}`)
+	req.Header.Set("If-Match", `"1"`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.patchDevice(res, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+	assert.Equal(t, "racer", dao.devices[0].Name)
+	assert.Equal(t, float64(1), dao.devices[0].Value)
+	assert.Equal(t, map[string]string{"site": "krk"}, dao.devices[0].Tags)
+}
+
+func TestPatchDeviceGivesUpAfterRepeatedConcurrentUpdates(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := racingDeviceDAO{inMemoryDeviceDAO: inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 1)}}, races: maxPatchAttempts}
+	req := createDeviceRequest(http.MethodPatch, id.Hex(), `{"value":7}`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.patchDevice(res, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+	assert.Equal(t, float64(1), dao.devices[0].Value)
+}
+
+// racingDeviceDAO updates the device behind the caller's back right after it
+// has been read, the given number of times.
+type racingDeviceDAO struct {
+	inMemoryDeviceDAO
+	races int
+}
+
+func (db *racingDeviceDAO) GetByID(ctx context.Context, id string) (*Device, error) {
+	device, err := db.inMemoryDeviceDAO.GetByID(ctx, id)
+	if err != nil || db.races == 0 {
+		return device, err
+	}
+
+	db.races--
+	racer := *device
+	racer.Name = "racer"
+	if _, err := db.inMemoryDeviceDAO.Update(ctx, id, racer, device.Version); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+}
+
+func TestPatchDeviceNotFound(t *testing.T) {
+	req := createDeviceRequest(http.MethodPatch, primitive.NewObjectID().Hex(), `{"value":7}`)
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	underTest.patchDevice(res, req)
+
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestDeleteDeviceExists(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "device", Interval: Interval(time.Second), Value: 1}}}
+	req := createDeviceRequest(http.MethodDelete, id.Hex(), "")
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	underTest.deleteDevice(res, req)
+
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Empty(t, dao.devices)
+}
+
+func TestDeleteDeviceWithIfMatch(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{newVersionedDevice(id, 3)}}
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &dao}}
+
+	staleReq := createDeviceRequest(http.MethodDelete, id.Hex(), "")
+	staleReq.Header.Set("If-Match", `"2"`)
+	staleRes := httptest.NewRecorder()
+	underTest.deleteDevice(staleRes, staleReq)
+
+	assert.Equal(t, http.StatusPreconditionFailed, staleRes.Code)
+	assert.Len(t, dao.devices, 1)
+
+	req := createDeviceRequest(http.MethodDelete, id.Hex(), "")
+	req.Header.Set("If-Match", `"3"`)
+	res := httptest.NewRecorder()
+	underTest.deleteDevice(res, req)
+
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Empty(t, dao.devices)
+}
+
+func TestUpdateAndDeleteMissingDeviceWithIfMatch(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	updateReq := createDeviceRequest(http.MethodPut, id, `{"name":"updated","interval":"1s"}`)
+	updateReq.Header.Set("If-Match", `"1"`)
+	updateRes := httptest.NewRecorder()
+	underTest.updateDevice(updateRes, updateReq)
+
+	deleteReq := createDeviceRequest(http.MethodDelete, id, "")
+	deleteReq.Header.Set("If-Match", `"1"`)
+	deleteRes := httptest.NewRecorder()
+	underTest.deleteDevice(deleteRes, deleteReq)
+
+	assert.Equal(t, http.StatusPreconditionFailed, updateRes.Code)
+	assert.Equal(t, http.StatusPreconditionFailed, deleteRes.Code)
+}
+
+func TestDeleteDeviceNotFound(t *testing.T) {
+	req := createDeviceRequest(http.MethodDelete, primitive.NewObjectID().Hex(), "")
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	underTest.deleteDevice(res, req)
+
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestUpdateAndDeleteDeviceInvalidID(t *testing.T) {
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &inMemoryDeviceDAO{}}}
+
+	updateRes := httptest.NewRecorder()
+	underTest.updateDevice(updateRes, createDeviceRequest(http.MethodPut, "garbage", `{"name":"updated","interval":"1s"}`))
+	deleteRes := httptest.NewRecorder()
+	underTest.deleteDevice(deleteRes, createDeviceRequest(http.MethodDelete, "garbage", ""))
+
+	assert.Equal(t, http.StatusBadRequest, updateRes.Code)
+	assert.Equal(t, http.StatusBadRequest, deleteRes.Code)
+}
+
+func TestDeleteDeviceDatabaseError(t *testing.T) {
+	req := createDeviceRequest(http.MethodDelete, primitive.NewObjectID().Hex(), "")
+	res := httptest.NewRecorder()
+	underTest := deviceHTTPHandler{service: &DeviceService{dao: &failingDeviceDAO{}}}
+
+	underTest.deleteDevice(res, req)
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+}
+
+func fixedClock() time.Time {
+	return time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func newVersionedDevice(id primitive.ObjectID, version int64) Device {
+	createdAt := fixedClock().AddDate(0, 0, -1)
+	return Device{
+		ID:        id,
+		Name:      "device",
+		Interval:  Interval(time.Second),
+		Value:     1,
+		CreatedAt: &createdAt,
+		UpdatedAt: &createdAt,
+		Version:   version,
+	}
+}
+
+func createDeviceRequest(method string, id string, body string) *http.Request {
+	req := httptest.NewRequest(method, "/devices/"+id, strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{
+		"id": id,
+	})
+	return req
 }
 
 type failingDeviceDAO struct {
@@ -176,6 +714,18 @@ func (db *failingDeviceDAO) GetByID(_ context.Context, _ string) (*Device, error
 	return nil, errors.New(fmt.Sprintf("mock error - failed to get device by id"))
 }
 
-func (db *failingDeviceDAO) GetAll(_ context.Context, _ int, _ int) ([]Device, error) {
+func (db *failingDeviceDAO) GetAll(_ context.Context, _ DeviceQuery) ([]Device, error) {
 	return nil, errors.New(fmt.Sprintf("mock error - failed to get all devices"))
 }
+
+func (db *failingDeviceDAO) Count(_ context.Context, _ DeviceQuery) (int64, error) {
+	return 0, errors.New("mock error - failed to count devices")
+}
+
+func (db *failingDeviceDAO) Update(_ context.Context, _ string, _ Device, _ int64) (*Device, error) {
+	return nil, errors.New("mock error - failed to update device")
+}
+
+func (db *failingDeviceDAO) Delete(_ context.Context, _ string, _ int64) (bool, error) {
+	return false, errors.New("mock error - failed to delete device")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"regexp"
+	"strings"
+)
+
+const maxDevicesPerPage = 1000
+
+const (
+	sortByName      = "name"
+	sortByInterval  = "interval"
+	sortByValue     = "value"
+	sortByCreatedAt = "createdAt"
+)
+
+// DeviceQuery selects a page of devices. Zero values mean no filtering and
+// ordering by creation. The DAOs treat a zero Limit as no limit, but the
+// service requires one, so callers outside it go through pages.
+type DeviceQuery struct {
+	Limit int
+
+	// Cursor is the opaque token of the page to return, taken from the
+	// NextCursor of the previous page. Empty means the first page.
+	Cursor string
+	// IncludeTotal asks for the number of devices matching the filters.
+	IncludeTotal bool
+
+	// Name matches devices whose name contains it, ignoring case.
+	Name string
+	// NameRegex matches device names against a regular expression.
+	NameRegex string
+
+	MinInterval Interval
+	MaxInterval Interval
+	MinValue    *float64
+	MaxValue    *float64
+
+	// Tags matches devices that have all the given tags.
+	Tags map[string]string
+	// Unit matches devices with exactly this unit.
+	Unit string
+
+	// Sort is one of name, interval, value or createdAt, prefixed with "-"
+	// for descending order. Ties are broken by id.
+	Sort string
+
+	// after is the decoded Cursor the DAOs continue from.
+	after *deviceCursor
+}
+
+// deviceCursor identifies the last device of a page by its sort key and id,
+// so the next page starts right after it regardless of concurrent inserts.
+type deviceCursor struct {
+	Sort     string             `json:"s,omitempty"`
+	Name     string             `json:"n,omitempty"`
+	Interval int64              `json:"i,omitempty"`
+	Value    float64            `json:"v,omitempty"`
+	ID       primitive.ObjectID `json:"id"`
+}
+
+func newDeviceCursor(device Device, sort string) *deviceCursor {
+	return &deviceCursor{
+		Sort:     sort,
+		Name:     device.Name,
+		Interval: int64(device.Interval),
+		Value:    device.Value,
+		ID:       device.ID,
+	}
+}
+
+// device returns a device with the sort keys of the cursor, so it can be
+// compared with stored devices.
+func (c *deviceCursor) device() Device {
+	return Device{ID: c.ID, Name: c.Name, Interval: Interval(c.Interval), Value: c.Value}
+}
+
+func (c *deviceCursor) encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		// marshalling a struct of strings and numbers can't fail
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeDeviceCursor(token string) (*deviceCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var c deviceCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (q DeviceQuery) validate() error {
+	if q.Limit < 1 || q.Limit > maxDevicesPerPage {
+		return &ValidationError{Field: "limit", Reason: fmt.Sprintf("limit must be a number between 1 and %d", maxDevicesPerPage)}
+	}
+
+	if q.NameRegex != "" {
+		if _, err := regexp.Compile(q.NameRegex); err != nil {
+			return &ValidationError{Field: "nameRegex", Reason: fmt.Sprintf("invalid name regex: %v", err)}
+		}
+	}
+
+	if q.MinInterval > 0 && q.MaxInterval > 0 && q.MinInterval > q.MaxInterval {
+		return &ValidationError{Field: "minInterval", Reason: "minInterval can't be greater than maxInterval"}
+	}
+
+	if q.MinValue != nil && q.MaxValue != nil && *q.MinValue > *q.MaxValue {
+		return &ValidationError{Field: "minValue", Reason: "minValue can't be greater than maxValue"}
+	}
+
+	if _, _, err := q.sortField(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// withCursor decodes the cursor and checks that it was issued for the same
+// sort order, otherwise the page would start at a random place.
+func (q DeviceQuery) withCursor() (DeviceQuery, error) {
+	if q.Cursor == "" {
+		return q, nil
+	}
+
+	cursor, err := decodeDeviceCursor(q.Cursor)
+	if err != nil {
+		return q, &ValidationError{Field: "cursor", Reason: "invalid cursor"}
+	}
+
+	if cursor.Sort != q.Sort {
+		return q, &ValidationError{Field: "cursor", Reason: "cursor was issued for a different sort order"}
+	}
+
+	q.after = cursor
+	return q, nil
+}
+
+// sortField returns the field to sort by and whether the order is descending.
+func (q DeviceQuery) sortField() (string, bool, error) {
+	if q.Sort == "" {
+		return sortByCreatedAt, false, nil
+	}
+
+	field := strings.TrimPrefix(q.Sort, "-")
+	switch field {
+	case sortByName, sortByInterval, sortByValue, sortByCreatedAt:
+		return field, field != q.Sort, nil
+	default:
+		return "", false, &ValidationError{Field: "sort", Reason: "sort must be one of: name, interval, value, createdAt, optionally prefixed with -"}
+	}
+}
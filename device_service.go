@@ -3,90 +3,349 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
+	"strings"
+	"time"
 )
 
 const (
 	validationEmptyDeviceNameErr = "device name can't be empty"
-	validationWrongIntervalErr   = "interval has to be greater than 0"
+	validationWrongIntervalErr   = "interval has to be at least 1ms"
+	validationWrongGeneratorErr  = "invalid generator"
+	validationWrongTagErr        = "invalid tag"
+	validationWrongLocationErr   = "location has to have lat between -90 and 90 and lon between -180 and 180"
 	daoSaveErr                   = "failed to save device"
 	daoGetErr                    = "failed to get device"
 	daoGetAllErr                 = "failed to get all devices"
+	daoCountErr                  = "failed to count devices"
+	daoUpdateErr                 = "failed to update device"
+	daoDeleteErr                 = "failed to delete device"
 )
 
 type Device struct {
-	ID       primitive.ObjectID `json:"id" bson:"_id"`
-	Name     string             `json:"name" bson:"name"`
-	Interval int                `json:"interval" bson:"interval"`
-	Value    float64            `json:"value" bson:"value"`
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Name        string             `json:"name" bson:"name"`
+	Interval    Interval           `json:"interval" bson:"interval"`
+	Value       float64            `json:"value" bson:"value"`
+	Generator   *GeneratorConfig   `json:"generator,omitempty" bson:"generator,omitempty"`
+	Tags        map[string]string  `json:"tags,omitempty" bson:"tags,omitempty"`
+	Unit        string             `json:"unit,omitempty" bson:"unit,omitempty"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	Location    *Location          `json:"location,omitempty" bson:"location,omitempty"`
+	CreatedAt   *time.Time         `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+	UpdatedAt   *time.Time         `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	Version     int64              `json:"version,omitempty" bson:"version,omitempty"`
+	Status      string             `json:"status,omitempty" bson:"-"`
+}
+
+type Location struct {
+	Lat float64 `json:"lat" bson:"lat"`
+	Lon float64 `json:"lon" bson:"lon"`
+}
+
+// tenantTag scopes unique device names when names are unique per tenant.
+const tenantTag = "tenant"
+
+// auditTime is the precision of createdAt and updatedAt, the one of BSON dates.
+func auditTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// deviceNameConflict is returned by the DAOs when the device name is taken.
+func deviceNameConflict(device Device) error {
+	return &ConflictError{Resource: "device", Field: "name", Value: device.Name}
 }
 
 type deviceDAO interface {
 	Save(ctx context.Context, device Device) (Device, error)
 	GetByID(ctx context.Context, id string) (*Device, error)
-	GetAll(ctx context.Context, limit int, page int) ([]Device, error)
+	GetAll(ctx context.Context, query DeviceQuery) ([]Device, error)
+	Count(ctx context.Context, query DeviceQuery) (int64, error)
+	// Update and Delete only change the device when its version is ifVersion,
+	// unless ifVersion is 0, and return a VersionMismatchError otherwise.
+	Update(ctx context.Context, id string, device Device, ifVersion int64) (*Device, error)
+	Delete(ctx context.Context, id string, ifVersion int64) (bool, error)
 }
 
 type DeviceCreateObserver interface {
 	NotifyDeviceCreated(device Device)
 }
 
+type DeviceUpdateObserver interface {
+	NotifyDeviceUpdated(device Device)
+}
+
+type DeviceDeleteObserver interface {
+	NotifyDeviceDeleted(id string)
+}
+
 type DeviceService struct {
-	dao       deviceDAO
-	observers []DeviceCreateObserver
+	dao             deviceDAO
+	replay          *replayStore
+	observers       []DeviceCreateObserver
+	updateObservers []DeviceUpdateObserver
+	deleteObservers []DeviceDeleteObserver
 }
 
 func (s *DeviceService) AddObserver(observer DeviceCreateObserver) {
 	s.observers = append(s.observers, observer)
 }
 
+func (s *DeviceService) AddUpdateObserver(observer DeviceUpdateObserver) {
+	s.updateObservers = append(s.updateObservers, observer)
+}
+
+func (s *DeviceService) AddDeleteObserver(observer DeviceDeleteObserver) {
+	s.deleteObservers = append(s.deleteObservers, observer)
+}
+
 func (s *DeviceService) CreateDevice(ctx context.Context, device Device) (Device, error) {
+	savedDevice, err := s.saveDevice(ctx, device)
+	if err != nil {
+		return device, err
+	}
+
+	s.notifyCreated(savedDevice)
+
+	return savedDevice, nil
+}
+
+// saveDevice validates and saves the device without notifying observers.
+func (s *DeviceService) saveDevice(ctx context.Context, device Device) (Device, error) {
 	if err := s.validate(device); err != nil {
 		return device, err
 	}
 
 	savedDevice, err := s.dao.Save(ctx, device)
 	if err != nil {
+		if isClientErr(err) {
+			return device, err
+		}
+
 		log.Print(err)
-		return device, errors.New(daoSaveErr)
+		return device, &StorageError{Op: daoSaveErr, Err: err}
 	}
 
+	return savedDevice, nil
+}
+
+func (s *DeviceService) notifyCreated(device Device) {
 	for _, observer := range s.observers {
-		observer.NotifyDeviceCreated(savedDevice)
+		observer.NotifyDeviceCreated(device)
 	}
-
-	return savedDevice, nil
 }
 
 func (s *DeviceService) validate(device Device) error {
 	if device.Name == "" {
-		return errors.New(validationEmptyDeviceNameErr)
+		return &ValidationError{Field: "name", Reason: validationEmptyDeviceNameErr}
 	}
 
-	if device.Interval <= 0 {
-		return errors.New(validationWrongIntervalErr)
+	if device.Interval.Duration() < time.Millisecond {
+		return &ValidationError{Field: "interval", Reason: validationWrongIntervalErr}
+	}
+
+	if _, err := newValueGenerator(device, s.replay); err != nil {
+		return &ValidationError{Field: "generator", Reason: fmt.Sprintf("%v: %v", validationWrongGeneratorErr, err)}
+	}
+
+	for key, value := range device.Tags {
+		if err := validateTag(key, value); err != nil {
+			return &ValidationError{Field: "tags", Reason: fmt.Sprintf("%v %q: %v", validationWrongTagErr, key, err)}
+		}
+	}
+
+	if l := device.Location; l != nil && (l.Lat < -90 || l.Lat > 90 || l.Lon < -180 || l.Lon > 180) {
+		return &ValidationError{Field: "location", Reason: validationWrongLocationErr}
 	}
 
 	return nil
 }
 
+// validateTag checks that a tag can be written to InfluxDB as is.
+func validateTag(key string, value string) error {
+	if err := validateTagKey(key); err != nil {
+		return err
+	}
+
+	if value == "" {
+		return errors.New("value can't be empty")
+	}
+
+	return nil
+}
+
+// validateTagKey refuses keys used by tsm itself, keys starting with "_",
+// reserved by InfluxDB, and keys Mongo would read as a nested path or an
+// operator when filtering by tags.
+func validateTagKey(key string) error {
+	switch {
+	case key == "":
+		return errors.New("key can't be empty")
+	case key == deviceIDTag || key == unitTag || key == measurementField:
+		return errors.New("key is reserved")
+	case strings.HasPrefix(key, "_"):
+		return errors.New("key can't start with _")
+	case strings.HasPrefix(key, "$"):
+		return errors.New("key can't start with $")
+	case strings.Contains(key, "."):
+		return errors.New("key can't contain .")
+	default:
+		return nil
+	}
+}
+
 func (s *DeviceService) GetByID(ctx context.Context, id string) (*Device, error) {
 	device, err := s.dao.GetByID(ctx, id)
 	if err != nil {
+		if isClientErr(err) {
+			return nil, err
+		}
+
 		log.Print(err)
-		return nil, errors.New(daoGetErr)
+		return nil, &StorageError{Op: daoGetErr, Err: err}
+	}
+
+	if device == nil {
+		return nil, &NotFoundError{Resource: "device", ID: id}
 	}
 
 	return device, nil
 }
 
-func (s *DeviceService) GetAll(ctx context.Context, limit int, page int) ([]Device, error) {
-	devices, err := s.dao.GetAll(ctx, limit, page)
+// DevicePage is a page of devices. NextCursor is empty on the last page and
+// Total is only set when the query asked for it.
+type DevicePage struct {
+	Devices    []Device
+	NextCursor string
+	Total      *int64
+}
+
+func (s *DeviceService) GetAll(ctx context.Context, query DeviceQuery) (DevicePage, error) {
+	if err := query.validate(); err != nil {
+		return DevicePage{}, err
+	}
+
+	query, err := query.withCursor()
+	if err != nil {
+		return DevicePage{}, err
+	}
+
+	// one more device than requested tells whether there is a next page
+	daoQuery := query
+	daoQuery.Limit++
+
+	devices, err := s.dao.GetAll(ctx, daoQuery)
 	if err != nil {
 		log.Print(err)
-		return nil, errors.New(daoGetAllErr)
+		return DevicePage{}, &StorageError{Op: daoGetAllErr, Err: err}
 	}
 
-	return devices, nil
+	page := DevicePage{Devices: devices}
+	if len(devices) > query.Limit {
+		page.Devices = devices[:query.Limit]
+		page.NextCursor = newDeviceCursor(page.Devices[query.Limit-1], query.Sort).encode()
+	}
+
+	if query.IncludeTotal {
+		total, err := s.dao.Count(ctx, query)
+		if err != nil {
+			log.Print(err)
+			return DevicePage{}, &StorageError{Op: daoCountErr, Err: err}
+		}
+		page.Total = &total
+	}
+
+	return page, nil
+}
+
+// ForEach calls fn for every device matching the query, going through all
+// pages. It stops at the first error returned by fn.
+func (s *DeviceService) ForEach(ctx context.Context, query DeviceQuery, fn func(device Device) error) error {
+	query.Limit = maxDevicesPerPage
+	query.IncludeTotal = false
+
+	for {
+		page, err := s.GetAll(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		for _, device := range page.Devices {
+			if err := fn(device); err != nil {
+				return err
+			}
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+// UpdateDevice replaces the device. A non zero ifVersion makes the update
+// conditional on the stored version, so concurrent edits aren't lost.
+func (s *DeviceService) UpdateDevice(ctx context.Context, id string, device Device, ifVersion int64) (*Device, error) {
+	if err := s.validate(device); err != nil {
+		return nil, err
+	}
+
+	updatedDevice, err := s.dao.Update(ctx, id, device, ifVersion)
+	if err != nil {
+		if isClientErr(err) {
+			return nil, err
+		}
+
+		log.Print(err)
+		return nil, &StorageError{Op: daoUpdateErr, Err: err}
+	}
+
+	if updatedDevice == nil {
+		return nil, &NotFoundError{Resource: "device", ID: id}
+	}
+
+	for _, observer := range s.updateObservers {
+		observer.NotifyDeviceUpdated(*updatedDevice)
+	}
+
+	return updatedDevice, nil
+}
+
+func (s *DeviceService) DeleteDevice(ctx context.Context, id string, ifVersion int64) error {
+	if err := s.removeDevice(ctx, id, ifVersion); err != nil {
+		return err
+	}
+
+	for _, observer := range s.deleteObservers {
+		observer.NotifyDeviceDeleted(id)
+	}
+
+	return nil
+}
+
+// removeDevice deletes the device without notifying observers.
+func (s *DeviceService) removeDevice(ctx context.Context, id string, ifVersion int64) error {
+	deleted, err := s.dao.Delete(ctx, id, ifVersion)
+	if err != nil {
+		if isClientErr(err) {
+			return err
+		}
+
+		log.Print(err)
+		return &StorageError{Op: daoDeleteErr, Err: err}
+	}
+
+	if !deleted {
+		return &NotFoundError{Resource: "device", ID: id}
+	}
+
+	return nil
+}
+
+// isClientErr tells whether a DAO error is caused by the request, so it is
+// returned as is instead of being reported as a storage failure.
+func isClientErr(err error) bool {
+	return errors.Is(err, ErrValidation) || errors.Is(err, ErrConflict) || errors.Is(err, ErrPreconditionFailed)
 }
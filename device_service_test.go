@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"testing"
+	"time"
 )
 
 func TestCreateDeviceWithWrongInterval(t *testing.T) {
@@ -19,7 +24,7 @@ func TestCreateDeviceWithWrongInterval(t *testing.T) {
 func TestCreateDeviceWithoutName(t *testing.T) {
 	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
 
-	device := Device{Interval: 1, Value: 1}
+	device := Device{Interval: Interval(time.Second), Value: 1}
 
 	_, err := underTest.CreateDevice(context.Background(), device)
 
@@ -29,22 +34,60 @@ func TestCreateDeviceWithoutName(t *testing.T) {
 func TestCreateDeviceWithCorrectData(t *testing.T) {
 	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
 
-	device := Device{Name: "name", Interval: 1, Value: 1}
+	device := Device{Name: "name", Interval: Interval(time.Second), Value: 1}
 
 	_, err := underTest.CreateDevice(context.Background(), device)
 
 	assert.NoError(t, err, "Device with correct data should be created")
 }
 
+func TestCreateDeviceWithInvalidGeneratorIsValidationError(t *testing.T) {
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
+
+	device := Device{Name: "name", Interval: Interval(time.Second), Generator: &GeneratorConfig{Type: generatorSine}}
+
+	_, err := underTest.CreateDevice(context.Background(), device)
+
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrValidation), fmt.Sprintf("%v should be a validation error", err))
+}
+
+func TestCreateDeviceWithInvalidMetadata(t *testing.T) {
+	testCases := map[string]Device{
+		"reserved tag":           {Tags: map[string]string{deviceIDTag: "other"}},
+		"influx reserved tag":    {Tags: map[string]string{"_field": "x"}},
+		"influx field tag":       {Tags: map[string]string{measurementField: "x"}},
+		"mongo path tag":         {Tags: map[string]string{"site.room": "x"}},
+		"mongo operator tag":     {Tags: map[string]string{"$gt": "x"}},
+		"empty tag value":        {Tags: map[string]string{"site": ""}},
+		"latitude out of range":  {Location: &Location{Lat: 91, Lon: 0}},
+		"longitude out of range": {Location: &Location{Lat: 0, Lon: -181}},
+	}
+
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
+
+	for name, device := range testCases {
+		t.Run(name, func(t *testing.T) {
+			device.Name = "name"
+			device.Interval = Interval(time.Second)
+
+			_, err := underTest.CreateDevice(context.Background(), device)
+
+			assert.True(t, errors.Is(err, ErrValidation), fmt.Sprintf("%v should be a validation error", err))
+		})
+	}
+}
+
 func TestCreateValidDeviceButErrorWhenSavingByDAO(t *testing.T) {
 	underTest := DeviceService{dao: &failingDeviceDAO{}}
 
-	device := Device{Name: "name", Interval: 1, Value: 1}
+	device := Device{Name: "name", Interval: Interval(time.Second), Value: 1}
 
 	_, err := underTest.CreateDevice(context.Background(), device)
 
 	assert.Error(t, err, "The error should be return when DAO fails")
 	assert.EqualError(t, err, daoSaveErr)
+	assert.True(t, errors.Is(err, ErrStorage))
 }
 
 func TestGetByIDErrorInDAO(t *testing.T) {
@@ -59,12 +102,99 @@ func TestGetByIDErrorInDAO(t *testing.T) {
 func TestGetAllErrorInDAO(t *testing.T) {
 	underTest := DeviceService{dao: &failingDeviceDAO{}}
 
-	_, err := underTest.GetAll(context.Background(), 0, 0)
+	_, err := underTest.GetAll(context.Background(), DeviceQuery{Limit: 10})
 
 	assert.Error(t, err, "The error should be return when DAO fails")
 	assert.EqualError(t, err, daoGetAllErr)
 }
 
+func TestGetAllRequiresLimit(t *testing.T) {
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
+
+	_, err := underTest.GetAll(context.Background(), DeviceQuery{})
+
+	assert.True(t, errors.Is(err, ErrValidation))
+}
+
+func TestForEachGoesThroughAllPages(t *testing.T) {
+	dao := inMemoryDeviceDAO{}
+	for i := 0; i < maxDevicesPerPage+1; i++ {
+		_, _ = dao.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: fmt.Sprintf("device %d", i), Interval: Interval(time.Second)})
+	}
+	underTest := DeviceService{dao: &dao}
+
+	seen := make(map[primitive.ObjectID]bool)
+	err := underTest.ForEach(context.Background(), DeviceQuery{}, func(device Device) error {
+		seen[device.ID] = true
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, seen, maxDevicesPerPage+1)
+}
+
+func TestUpdateDeviceWithWrongInterval(t *testing.T) {
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
+
+	device := Device{Name: "name", Interval: 0, Value: 1}
+
+	_, err := underTest.UpdateDevice(context.Background(), primitive.NewObjectID().Hex(), device, 0)
+
+	assert.EqualError(t, err, validationWrongIntervalErr)
+
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, "interval", validationErr.Field)
+}
+
+func TestUpdateDeviceErrorInDAO(t *testing.T) {
+	underTest := DeviceService{dao: &failingDeviceDAO{}}
+
+	device := Device{Name: "name", Interval: Interval(time.Second), Value: 1}
+
+	_, err := underTest.UpdateDevice(context.Background(), primitive.NewObjectID().Hex(), device, 0)
+
+	assert.Error(t, err, "The error should be return when DAO fails")
+	assert.EqualError(t, err, daoUpdateErr)
+}
+
+func TestDeleteDeviceErrorInDAO(t *testing.T) {
+	underTest := DeviceService{dao: &failingDeviceDAO{}}
+
+	err := underTest.DeleteDevice(context.Background(), primitive.NewObjectID().Hex(), 0)
+
+	assert.Error(t, err, "The error should be return when DAO fails")
+	assert.EqualError(t, err, daoDeleteErr)
+	assert.True(t, errors.Is(err, ErrStorage))
+}
+
+func TestGetByIDNotFound(t *testing.T) {
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
+	id := primitive.NewObjectID().Hex()
+
+	device, err := underTest.GetByID(context.Background(), id)
+
+	assert.Nil(t, device)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.EqualError(t, err, fmt.Sprintf("device with id %v not found", id))
+}
+
+func TestUpdateDeviceNotFoundIsNotFoundError(t *testing.T) {
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
+
+	_, err := underTest.UpdateDevice(context.Background(), primitive.NewObjectID().Hex(), Device{Name: "name", Interval: Interval(time.Second)}, 0)
+
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestDeleteDeviceNotFoundIsNotFoundError(t *testing.T) {
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
+
+	err := underTest.DeleteDevice(context.Background(), primitive.NewObjectID().Hex(), 0)
+
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
 func TestDeviceService_CreateDevice_NotifyAllObservers(t *testing.T) {
 	firstObserver := deviceServiceObserver{}
 	secondObserver := deviceServiceObserver{}
@@ -73,7 +203,7 @@ func TestDeviceService_CreateDevice_NotifyAllObservers(t *testing.T) {
 	underTest.AddObserver(&firstObserver)
 	underTest.AddObserver(&secondObserver)
 
-	device := Device{Name: "name", Interval: 1, Value: 1}
+	device := Device{Name: "name", Interval: Interval(time.Second), Value: 1}
 
 	_, _ = underTest.CreateDevice(context.Background(), device)
 
@@ -81,6 +211,41 @@ func TestDeviceService_CreateDevice_NotifyAllObservers(t *testing.T) {
 	assert.True(t, secondObserver.notified)
 }
 
+func TestDeviceService_UpdateDevice_NotifyUpdateObservers(t *testing.T) {
+	id := primitive.NewObjectID()
+	observer := deviceServiceObserver{}
+
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "name", Interval: Interval(time.Second)}}}}
+	underTest.AddUpdateObserver(&observer)
+
+	_, _ = underTest.UpdateDevice(context.Background(), id.Hex(), Device{Name: "name", Interval: Interval(2 * time.Second), Value: 1}, 0)
+
+	assert.True(t, observer.notified)
+}
+
+func TestDeviceService_UpdateDevice_NotFoundDoesNotNotify(t *testing.T) {
+	observer := deviceServiceObserver{}
+
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{}}
+	underTest.AddUpdateObserver(&observer)
+
+	_, _ = underTest.UpdateDevice(context.Background(), primitive.NewObjectID().Hex(), Device{Name: "name", Interval: Interval(2 * time.Second)}, 0)
+
+	assert.False(t, observer.notified)
+}
+
+func TestDeviceService_DeleteDevice_NotifyDeleteObservers(t *testing.T) {
+	id := primitive.NewObjectID()
+	observer := deviceServiceObserver{}
+
+	underTest := DeviceService{dao: &inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "name", Interval: Interval(time.Second)}}}}
+	underTest.AddDeleteObserver(&observer)
+
+	_ = underTest.DeleteDevice(context.Background(), id.Hex(), 0)
+
+	assert.True(t, observer.notified)
+}
+
 type deviceServiceObserver struct {
 	notified bool
 }
@@ -88,3 +253,11 @@ type deviceServiceObserver struct {
 func (o *deviceServiceObserver) NotifyDeviceCreated(_ Device) {
 	o.notified = true
 }
+
+func (o *deviceServiceObserver) NotifyDeviceUpdated(_ Device) {
+	o.notified = true
+}
+
+func (o *deviceServiceObserver) NotifyDeviceDeleted(_ string) {
+	o.notified = true
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Sentinel errors describe what went wrong independently of where. Handlers
+// check them with errors.Is to pick the response status.
+var (
+	ErrValidation         = errors.New("validation failed")
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrStorage            = errors.New("storage failure")
+)
+
+// ValidationError is returned when a request carries an invalid field.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// InvalidIDError is returned by the DAOs when an id is not a valid ObjectID,
+// so a malformed id is told apart from a device that doesn't exist.
+type InvalidIDError struct {
+	ID  string
+	Err error
+}
+
+func (e *InvalidIDError) Error() string {
+	return fmt.Sprintf("invalid id %q: must be a 24 character hex string", e.ID)
+}
+
+func (e *InvalidIDError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InvalidIDError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func parseObjectID(id string) (primitive.ObjectID, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, &InvalidIDError{ID: id, Err: err}
+	}
+
+	return objectID, nil
+}
+
+// NotFoundError is returned when the requested resource doesn't exist.
+type NotFoundError struct {
+	Resource string
+	ID       string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%v with id %v not found", e.Resource, e.ID)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// ConflictError is returned when a write would break a uniqueness rule.
+type ConflictError struct {
+	Resource string
+	Field    string
+	Value    string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v with %v %q already exists", e.Resource, e.Field, e.Value)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// VersionMismatchError is returned when a write expected another version of
+// the resource than the stored one, i.e. someone else changed it meanwhile.
+// Actual is 0 when the resource doesn't exist anymore.
+type VersionMismatchError struct {
+	Resource string
+	ID       string
+	Expected int64
+	Actual   int64
+}
+
+func (e *VersionMismatchError) Error() string {
+	if e.Actual == 0 {
+		return fmt.Sprintf("%v with id %v not found, expected version %d", e.Resource, e.ID, e.Expected)
+	}
+
+	return fmt.Sprintf("%v with id %v has version %d, not %d", e.Resource, e.ID, e.Actual, e.Expected)
+}
+
+func (e *VersionMismatchError) Is(target error) bool {
+	return target == ErrPreconditionFailed
+}
+
+// StorageError hides the storage failure behind a message that is safe to
+// return to clients while keeping the cause for errors.As and logging.
+type StorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return e.Op
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StorageError) Is(target error) bool {
+	return target == ErrStorage
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthStatusUp   = "up"
+	healthStatusDown = "down"
+
+	defaultHealthCheckTimeout = 2 * time.Second
+)
+
+// healthCheck reports whether a dependency is ready to serve requests.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type DependencyHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyHealth `json:"dependencies"`
+}
+
+type healthHTTPHandler struct {
+	checks  []healthCheck
+	timeout time.Duration
+}
+
+// liveness only tells that the process serves HTTP, so it never touches the
+// dependencies and a broken database doesn't get the app restarted.
+func (h *healthHTTPHandler) liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+	}{Status: healthStatusUp}); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *healthHTTPHandler) readiness(w http.ResponseWriter, r *http.Request) {
+	readiness := h.check(r.Context())
+
+	status := http.StatusOK
+	if readiness.Status != healthStatusUp {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(readiness); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *healthHTTPHandler) check(ctx context.Context) Readiness {
+	timeout := h.timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	readiness := Readiness{Status: healthStatusUp, Dependencies: make(map[string]DependencyHealth, len(h.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+
+			health := DependencyHealth{Status: healthStatusUp}
+			if err := c.check(ctx); err != nil {
+				log.Printf("%v is not ready: %v", c.name, err)
+				health = DependencyHealth{Status: healthStatusDown, Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			readiness.Dependencies[c.name] = health
+			if health.Status != healthStatusUp {
+				readiness.Status = healthStatusDown
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	return readiness
+}
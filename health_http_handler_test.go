@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLivenessIsAlwaysUp(t *testing.T) {
+	underTest := healthHTTPHandler{checks: []healthCheck{failingHealthCheck("mongo")}}
+	res := httptest.NewRecorder()
+
+	underTest.liveness(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, `{"status":"up"}`, res.Body.String())
+}
+
+func TestReadinessWhenAllDependenciesAreUp(t *testing.T) {
+	underTest := healthHTTPHandler{checks: []healthCheck{passingHealthCheck("mongo"), passingHealthCheck("rabbitmq")}}
+	res := httptest.NewRecorder()
+
+	underTest.readiness(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, `{"status":"up","dependencies":{
+		"mongo":{"status":"up"},
+		"rabbitmq":{"status":"up"}
+	}}`, res.Body.String())
+}
+
+func TestReadinessReportsFailingDependency(t *testing.T) {
+	underTest := healthHTTPHandler{checks: []healthCheck{passingHealthCheck("mongo"), failingHealthCheck("influxdb")}}
+	res := httptest.NewRecorder()
+
+	underTest.readiness(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	require.JSONEq(t, `{"status":"down","dependencies":{
+		"mongo":{"status":"up"},
+		"influxdb":{"status":"down","error":"influxdb unavailable"}
+	}}`, res.Body.String())
+}
+
+func TestReadinessTimesOutSlowDependency(t *testing.T) {
+	slow := healthCheck{name: "mongo", check: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	underTest := healthHTTPHandler{checks: []healthCheck{slow}, timeout: 10 * time.Millisecond}
+	res := httptest.NewRecorder()
+
+	underTest.readiness(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	require.JSONEq(t, `{"status":"down","dependencies":{
+		"mongo":{"status":"down","error":"context deadline exceeded"}
+	}}`, res.Body.String())
+}
+
+func passingHealthCheck(name string) healthCheck {
+	return healthCheck{name: name, check: func(ctx context.Context) error {
+		return nil
+	}}
+}
+
+func failingHealthCheck(name string) healthCheck {
+	return healthCheck{name: name, check: func(ctx context.Context) error {
+		return errors.New(name + " unavailable")
+	}}
+}
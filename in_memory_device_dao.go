@@ -1,31 +1,83 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+// inMemoryDeviceDAO keeps devices in memory. Like mongoDeviceDAO it hands out
+// and stores copies, so callers never share tags, generator or location with
+// the stored devices.
 type inMemoryDeviceDAO struct {
 	mu      sync.Mutex
 	devices []Device
+	// uniqueNamePerTenant enforces unique names among devices with the same
+	// tenant tag only, like the unique index of mongoDeviceDAO.
+	uniqueNamePerTenant bool
+	// clock stamps createdAt and updatedAt, time.Now when not set.
+	clock func() time.Time
 }
 
 func (db *inMemoryDeviceDAO) Save(_ context.Context, device Device) (Device, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.devices = append(db.devices, device)
+	if db.nameTaken(device, -1) {
+		return device, deviceNameConflict(device)
+	}
+
+	now := db.now()
+	device.CreatedAt = &now
+	device.UpdatedAt = &now
+	device.Version = 1
+
+	db.devices = append(db.devices, copyDevice(device))
+
+	return copyDevice(device), nil
+}
+
+func (db *inMemoryDeviceDAO) now() time.Time {
+	if db.clock == nil {
+		return auditTime(time.Now())
+	}
 
-	return device, nil
+	return auditTime(db.clock())
+}
+
+// nameTaken tells whether a device other than the one at index skip has the
+// name of device. It has to be called with the lock held.
+func (db *inMemoryDeviceDAO) nameTaken(device Device, skip int) bool {
+	for i, other := range db.devices {
+		if i == skip || other.Name != device.Name {
+			continue
+		}
+
+		if !db.uniqueNamePerTenant || other.Tags[tenantTag] == device.Tags[tenantTag] {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (db *inMemoryDeviceDAO) GetByID(_ context.Context, id string) (*Device, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	searchID, err := parseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, device := range db.devices {
-		if searchID, err := primitive.ObjectIDFromHex(id); err != nil {
-			return nil, err
-		} else if device.ID == searchID {
+		if device.ID == searchID {
+			device = copyDevice(device)
 			return &device, nil
 		}
 	}
@@ -33,24 +85,252 @@ func (db *inMemoryDeviceDAO) GetByID(_ context.Context, id string) (*Device, err
 	return nil, nil
 }
 
-func (db *inMemoryDeviceDAO) GetAll(_ context.Context, limit int, page int) ([]Device, error) {
-	if limit < 0 {
+func (db *inMemoryDeviceDAO) GetAll(_ context.Context, query DeviceQuery) ([]Device, error) {
+	if query.Limit < 0 {
 		return nil, errors.New("limit can't be negative")
 	}
 
-	if limit == 0 {
-		return append([]Device(nil), db.devices...), nil
+	field, descending, err := query.sortField()
+	if err != nil {
+		return nil, err
+	}
+
+	var nameRegex *regexp.Regexp
+	if query.NameRegex != "" {
+		if nameRegex, err = regexp.Compile(query.NameRegex); err != nil {
+			return nil, err
+		}
+	}
+
+	db.mu.Lock()
+	devices := make([]Device, 0, len(db.devices))
+	for _, device := range db.devices {
+		if matchesDeviceQuery(device, query, nameRegex) {
+			devices = append(devices, copyDevice(device))
+		}
+	}
+	db.mu.Unlock()
+
+	less := func(a Device, b Device) bool {
+		if c := compareDevices(a, b, field); c != 0 {
+			return (c < 0) != descending
+		}
+		return bytes.Compare(a.ID[:], b.ID[:]) < 0
+	}
+
+	sort.SliceStable(devices, func(i, j int) bool {
+		return less(devices[i], devices[j])
+	})
+
+	if query.after != nil {
+		after := query.after.device()
+		start := sort.Search(len(devices), func(i int) bool {
+			return less(after, devices[i])
+		})
+		devices = devices[start:]
+	}
+
+	if query.Limit > 0 && len(devices) > query.Limit {
+		devices = devices[:query.Limit]
+	}
+
+	return devices, nil
+}
+
+func (db *inMemoryDeviceDAO) Count(_ context.Context, query DeviceQuery) (int64, error) {
+	var nameRegex *regexp.Regexp
+	if query.NameRegex != "" {
+		var err error
+		if nameRegex, err = regexp.Compile(query.NameRegex); err != nil {
+			return 0, err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var count int64
+	for _, device := range db.devices {
+		if matchesDeviceQuery(device, query, nameRegex) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func matchesDeviceQuery(device Device, query DeviceQuery, nameRegex *regexp.Regexp) bool {
+	if query.Name != "" && !strings.Contains(strings.ToLower(device.Name), strings.ToLower(query.Name)) {
+		return false
+	}
+
+	if nameRegex != nil && !nameRegex.MatchString(device.Name) {
+		return false
+	}
+
+	if query.MinInterval > 0 && device.Interval < query.MinInterval {
+		return false
 	}
 
-	start := limit * page
-	if start >= len(db.devices) {
-		return []Device{}, nil
+	if query.MaxInterval > 0 && device.Interval > query.MaxInterval {
+		return false
 	}
 
-	end := start + limit
-	if end > len(db.devices) {
-		end = len(db.devices)
+	if query.MinValue != nil && device.Value < *query.MinValue {
+		return false
+	}
+
+	if query.MaxValue != nil && device.Value > *query.MaxValue {
+		return false
+	}
+
+	if query.Unit != "" && device.Unit != query.Unit {
+		return false
+	}
+
+	for key, value := range query.Tags {
+		if tag, ok := device.Tags[key]; !ok || tag != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func compareDevices(a Device, b Device, field string) int {
+	switch field {
+	case sortByName:
+		return strings.Compare(a.Name, b.Name)
+	case sortByInterval:
+		return compareFloats(float64(a.Interval), float64(b.Interval))
+	case sortByValue:
+		return compareFloats(a.Value, b.Value)
+	case sortByCreatedAt:
+		return bytes.Compare(a.ID[:], b.ID[:])
+	default:
+		return 0
+	}
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (db *inMemoryDeviceDAO) Update(_ context.Context, id string, device Device, ifVersion int64) (*Device, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	searchID, err := parseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range db.devices {
+		if db.devices[i].ID == searchID {
+			current := db.devices[i]
+			if ifVersion > 0 && current.Version != ifVersion {
+				return nil, &VersionMismatchError{Resource: "device", ID: id, Expected: ifVersion, Actual: current.Version}
+			}
+
+			if db.nameTaken(device, i) {
+				return nil, deviceNameConflict(device)
+			}
+
+			now := db.now()
+			device.ID = searchID
+			device.CreatedAt = current.CreatedAt
+			if device.CreatedAt == nil {
+				createdAt := searchID.Timestamp().UTC()
+				device.CreatedAt = &createdAt
+			}
+			device.UpdatedAt = &now
+			device.Version = current.Version + 1
+			device.Status = ""
+
+			db.devices[i] = copyDevice(device)
+			device = copyDevice(device)
+			return &device, nil
+		}
+	}
+
+	return nil, missingDeviceVersion(id, ifVersion)
+}
+
+func (db *inMemoryDeviceDAO) Delete(_ context.Context, id string, ifVersion int64) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	searchID, err := parseObjectID(id)
+	if err != nil {
+		return false, err
+	}
+
+	for i := range db.devices {
+		if db.devices[i].ID == searchID {
+			if ifVersion > 0 && db.devices[i].Version != ifVersion {
+				return false, &VersionMismatchError{Resource: "device", ID: id, Expected: ifVersion, Actual: db.devices[i].Version}
+			}
+
+			db.devices = append(db.devices[:i], db.devices[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, missingDeviceVersion(id, ifVersion)
+}
+
+// copyDevice copies the maps and pointers of device along with it.
+func copyDevice(device Device) Device {
+	if device.Generator != nil {
+		generator := *device.Generator
+		if generator.Params != nil {
+			generator.Params = make(map[string]float64, len(device.Generator.Params))
+			for k, v := range device.Generator.Params {
+				generator.Params[k] = v
+			}
+		}
+		device.Generator = &generator
+	}
+
+	if device.Tags != nil {
+		tags := make(map[string]string, len(device.Tags))
+		for k, v := range device.Tags {
+			tags[k] = v
+		}
+		device.Tags = tags
+	}
+
+	if device.Location != nil {
+		location := *device.Location
+		device.Location = &location
+	}
+
+	if device.CreatedAt != nil {
+		createdAt := *device.CreatedAt
+		device.CreatedAt = &createdAt
+	}
+
+	if device.UpdatedAt != nil {
+		updatedAt := *device.UpdatedAt
+		device.UpdatedAt = &updatedAt
+	}
+
+	return device
+}
+
+// missingDeviceVersion fails a conditional write of a missing device like
+// mongoDeviceDAO.versionMismatch does.
+func missingDeviceVersion(id string, ifVersion int64) error {
+	if ifVersion == 0 {
+		return nil
 	}
 
-	return append([]Device(nil), db.devices[start:end]...), nil
+	return &VersionMismatchError{Resource: "device", ID: id, Expected: ifVersion}
 }
@@ -2,16 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"testing"
+	"time"
 )
 
 func TestInMemoryDeviceDAO_GetPaging_NegativeLimitPassed(t *testing.T) {
 	underTest := inMemoryDeviceDAO{}
 
-	devices, err := underTest.GetAll(context.Background(), -1, 0)
+	devices, err := underTest.GetAll(context.Background(), DeviceQuery{Limit: -1})
 
 	assert.Nil(t, devices)
 	assert.Error(t, err)
@@ -33,40 +35,225 @@ func TestInMemoryDeviceDAO_GetPaging(t *testing.T) {
 
 	testCases := []struct {
 		limit    int
-		page     int
+		after    *Device
 		expected []Device
 	}{
-		{limit: 0, page: 0, expected: devices[:]},
-		{limit: 0, page: 1, expected: devices[:]},
+		{limit: 0, expected: devices[:]},
+		{limit: 0, after: &devices[4], expected: devices[5:]},
 
-		{limit: 1, page: 0, expected: []Device{devices[0]}},
-		{limit: 1, page: 1, expected: []Device{devices[1]}},
-		{limit: 1, page: 9, expected: []Device{devices[9]}},
-		{limit: 1, page: 10, expected: []Device{}},
+		{limit: 1, expected: []Device{devices[0]}},
+		{limit: 1, after: &devices[0], expected: []Device{devices[1]}},
+		{limit: 1, after: &devices[8], expected: []Device{devices[9]}},
+		{limit: 1, after: &devices[9], expected: []Device{}},
 
-		{limit: 2, page: 0, expected: devices[0:2]},
-		{limit: 2, page: 1, expected: devices[2:4]},
-		{limit: 2, page: 4, expected: devices[8:10]},
-		{limit: 2, page: 5, expected: []Device{}},
+		{limit: 4, expected: devices[0:4]},
+		{limit: 4, after: &devices[3], expected: devices[4:8]},
+		{limit: 4, after: &devices[7], expected: devices[8:10]},
 
-		{limit: 4, page: 0, expected: devices[0:4]},
-		{limit: 4, page: 1, expected: devices[4:8]},
-		{limit: 4, page: 2, expected: devices[8:10]},
-		{limit: 4, page: 3, expected: []Device{}},
-
-		{limit: 10, page: 0, expected: devices[:]},
-		{limit: 10, page: 1, expected: []Device{}},
-
-		{limit: 20, page: 0, expected: devices[:]},
-		{limit: 20, page: 1, expected: []Device{}},
+		{limit: 20, expected: devices[:]},
 	}
 
 	underTest := inMemoryDeviceDAO{devices: append([]Device(nil), devices...)}
 
 	for _, testCase := range testCases {
-		t.Run(fmt.Sprintf("limit:%v page:%v", testCase.limit, testCase.page), func(t *testing.T) {
-			result, _ := underTest.GetAll(context.Background(), testCase.limit, testCase.page)
+		query := DeviceQuery{Limit: testCase.limit}
+		name := fmt.Sprintf("limit:%v", testCase.limit)
+		if testCase.after != nil {
+			query.after = newDeviceCursor(*testCase.after, "")
+			name += " after:" + testCase.after.Name
+		}
+
+		t.Run(name, func(t *testing.T) {
+			result, _ := underTest.GetAll(context.Background(), query)
 			assert.ElementsMatch(t, testCase.expected, result)
 		})
 	}
 }
+
+func TestInMemoryDeviceDAO_PagingSkipsNothingWhenDevicesAreAdded(t *testing.T) {
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	underTest := inMemoryDeviceDAO{devices: []Device{{ID: first, Name: "b"}, {ID: second, Name: "c"}}}
+
+	page, _ := underTest.GetAll(context.Background(), DeviceQuery{Limit: 1, Sort: sortByName})
+	_, _ = underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "a"})
+	next, _ := underTest.GetAll(context.Background(), DeviceQuery{Limit: 1, Sort: sortByName, after: newDeviceCursor(page[0], sortByName)})
+
+	assert.Equal(t, first, page[0].ID)
+	assert.Equal(t, second, next[0].ID)
+}
+
+func TestInMemoryDeviceDAO_GetAllFilters(t *testing.T) {
+	low, high := 2.0, 5.0
+	devices := []Device{
+		{ID: primitive.NewObjectID(), Name: "Boiler 1", Interval: Interval(time.Second), Value: 1, Tags: map[string]string{"site": "krk"}},
+		{ID: primitive.NewObjectID(), Name: "boiler 2", Interval: Interval(5 * time.Second), Value: 3, Tags: map[string]string{"site": "waw"}, Unit: "°C"},
+		{ID: primitive.NewObjectID(), Name: "pump 1", Interval: Interval(10 * time.Second), Value: 5, Tags: map[string]string{"site": "krk"}},
+	}
+
+	testCases := map[string]struct {
+		query    DeviceQuery
+		expected []Device
+	}{
+		"name substring ignores case": {query: DeviceQuery{Name: "BOILER"}, expected: devices[0:2]},
+		"name regex":                  {query: DeviceQuery{NameRegex: "^[Bp].* 1$"}, expected: []Device{devices[0], devices[2]}},
+		"interval range":              {query: DeviceQuery{MinInterval: Interval(2 * time.Second), MaxInterval: Interval(10 * time.Second)}, expected: devices[1:3]},
+		"value range":                 {query: DeviceQuery{MinValue: &low, MaxValue: &high}, expected: devices[1:3]},
+		"tags":                        {query: DeviceQuery{Tags: map[string]string{"site": "krk"}}, expected: []Device{devices[0], devices[2]}},
+		"unit":                        {query: DeviceQuery{Unit: "°C"}, expected: devices[1:2]},
+		"combined":                    {query: DeviceQuery{Name: "1", Tags: map[string]string{"site": "krk"}, MaxValue: &low}, expected: devices[0:1]},
+	}
+
+	underTest := inMemoryDeviceDAO{devices: append([]Device(nil), devices...)}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			result, err := underTest.GetAll(context.Background(), testCase.query)
+
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expected, result)
+		})
+	}
+}
+
+func TestInMemoryDeviceDAO_GetAllSorts(t *testing.T) {
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+	devices := []Device{
+		{ID: ids[1], Name: "b", Interval: Interval(time.Second)},
+		{ID: ids[2], Name: "a", Interval: Interval(time.Second)},
+		{ID: ids[0], Name: "c", Interval: Interval(2 * time.Second)},
+	}
+
+	testCases := map[string][]primitive.ObjectID{
+		"":           {ids[0], ids[1], ids[2]},
+		"createdAt":  {ids[0], ids[1], ids[2]},
+		"-createdAt": {ids[2], ids[1], ids[0]},
+		"name":       {ids[2], ids[1], ids[0]},
+		"-name":      {ids[0], ids[1], ids[2]},
+		"interval":   {ids[1], ids[2], ids[0]},
+		"-interval":  {ids[0], ids[1], ids[2]},
+	}
+
+	underTest := inMemoryDeviceDAO{devices: devices}
+
+	for sort, expected := range testCases {
+		t.Run(sort, func(t *testing.T) {
+			result, err := underTest.GetAll(context.Background(), DeviceQuery{Sort: sort})
+
+			assert.NoError(t, err)
+			var resultIDs []primitive.ObjectID
+			for _, device := range result {
+				resultIDs = append(resultIDs, device.ID)
+			}
+			assert.Equal(t, expected, resultIDs)
+		})
+	}
+}
+
+func TestInMemoryDeviceDAO_UniqueNames(t *testing.T) {
+	underTest := inMemoryDeviceDAO{}
+	first, _ := underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "boiler"})
+	second, _ := underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "pump"})
+
+	_, saveErr := underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "boiler", Tags: map[string]string{tenantTag: "other"}})
+	_, renameErr := underTest.Update(context.Background(), second.ID.Hex(), Device{Name: "boiler"}, 0)
+	_, keepErr := underTest.Update(context.Background(), first.ID.Hex(), Device{Name: "boiler", Value: 1}, 0)
+
+	assert.True(t, errors.Is(saveErr, ErrConflict))
+	assert.True(t, errors.Is(renameErr, ErrConflict))
+	assert.NoError(t, keepErr)
+	assert.Len(t, underTest.devices, 2)
+}
+
+func TestInMemoryDeviceDAO_UniqueNamesPerTenant(t *testing.T) {
+	underTest := inMemoryDeviceDAO{uniqueNamePerTenant: true}
+	_, _ = underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "boiler", Tags: map[string]string{tenantTag: "acme"}})
+
+	_, otherTenantErr := underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "boiler", Tags: map[string]string{tenantTag: "globex"}})
+	_, sameTenantErr := underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "boiler", Tags: map[string]string{tenantTag: "acme"}})
+
+	assert.NoError(t, otherTenantErr)
+	assert.True(t, errors.Is(sameTenantErr, ErrConflict))
+}
+
+func TestInMemoryDeviceDAO_AuditFields(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	underTest := inMemoryDeviceDAO{clock: func() time.Time { return now }}
+	saved, _ := underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "boiler", Version: 9})
+
+	now = now.Add(time.Minute)
+	updated, err := underTest.Update(context.Background(), saved.ID.Hex(), Device{Name: "boiler", Value: 1}, 0)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), saved.Version)
+	assert.Equal(t, int64(2), updated.Version)
+	assert.Equal(t, saved.CreatedAt, updated.CreatedAt)
+	assert.Equal(t, now, *updated.UpdatedAt)
+}
+
+func TestInMemoryDeviceDAO_ConcurrentUpdatesOfSameVersion(t *testing.T) {
+	underTest := inMemoryDeviceDAO{}
+	saved, _ := underTest.Save(context.Background(), Device{ID: primitive.NewObjectID(), Name: "boiler"})
+
+	const writers = 10
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(value float64) {
+			_, err := underTest.Update(context.Background(), saved.ID.Hex(), Device{Name: "boiler", Value: value}, saved.Version)
+			errs <- err
+		}(float64(i))
+	}
+
+	var succeeded, mismatched int
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err == nil {
+			succeeded++
+		} else if errors.Is(err, ErrPreconditionFailed) {
+			mismatched++
+		}
+	}
+
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, writers-1, mismatched)
+	assert.Equal(t, int64(2), underTest.devices[0].Version)
+}
+
+func TestInMemoryDeviceDAO_ConditionalWriteOfMissingDevice(t *testing.T) {
+	underTest := inMemoryDeviceDAO{}
+	id := primitive.NewObjectID().Hex()
+
+	_, updateErr := underTest.Update(context.Background(), id, Device{Name: "boiler"}, 1)
+	_, deleteErr := underTest.Delete(context.Background(), id, 1)
+
+	assert.True(t, errors.Is(updateErr, ErrPreconditionFailed))
+	assert.True(t, errors.Is(deleteErr, ErrPreconditionFailed))
+}
+
+func TestInMemoryDeviceDAO_ReturnsCopies(t *testing.T) {
+	underTest := inMemoryDeviceDAO{}
+	saved, _ := underTest.Save(context.Background(), Device{
+		ID:        primitive.NewObjectID(),
+		Name:      "boiler",
+		Tags:      map[string]string{"site": "krk"},
+		Generator: &GeneratorConfig{Type: "sine", Params: map[string]float64{"amplitude": 1}},
+		Location:  &Location{Lat: 50, Lon: 20},
+	})
+	saved.Tags["site"] = "saved"
+
+	byID, _ := underTest.GetByID(context.Background(), saved.ID.Hex())
+	byID.Tags["site"] = "byID"
+	byID.Generator.Params["amplitude"] = 2
+	byID.Location.Lat = 0
+
+	all, _ := underTest.GetAll(context.Background(), DeviceQuery{})
+	all[0].Tags["site"] = "all"
+
+	updated, _ := underTest.Update(context.Background(), saved.ID.Hex(), *byID, 0)
+	updated.Tags["site"] = "updated"
+
+	stored := underTest.devices[0]
+	assert.Equal(t, map[string]string{"site": "byID"}, stored.Tags)
+	assert.Equal(t, map[string]float64{"amplitude": 2}, stored.Generator.Params)
+	assert.Equal(t, float64(0), stored.Location.Lat)
+	byID.Tags["site"] = "after update"
+	assert.Equal(t, "byID", underTest.devices[0].Tags["site"])
+}
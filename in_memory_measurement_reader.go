@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type inMemoryMeasurementReader struct {
+	mu           sync.Mutex
+	measurements map[string][]MeasurementPoint
+}
+
+func (db *inMemoryMeasurementReader) Read(_ context.Context, deviceID string, from time.Time, to time.Time, limit int) ([]MeasurementPoint, error) {
+	points := db.inRange(deviceID, from, to)
+
+	if limit > 0 && len(points) > limit {
+		points = points[:limit]
+	}
+
+	return points, nil
+}
+
+// Aggregate mirrors Flux aggregateWindow: windows are aligned to the Unix epoch
+// and every result is stamped with its window stop, truncated to the range stop.
+func (db *inMemoryMeasurementReader) Aggregate(_ context.Context, deviceID string, from time.Time, to time.Time, every time.Duration, fn aggregateFunc) ([]MeasurementPoint, error) {
+	points := db.inRange(deviceID, from, to)
+
+	result := make([]MeasurementPoint, 0)
+	for start := 0; start < len(points); {
+		windowStop := windowStart(points[start].Time, every).Add(every)
+		end := start
+		for end < len(points) && points[end].Time.Before(windowStop) {
+			end++
+		}
+
+		if windowStop.After(to) {
+			windowStop = to
+		}
+
+		result = append(result, MeasurementPoint{Time: windowStop, Value: aggregate(points[start:end], fn)})
+		start = end
+	}
+
+	return result, nil
+}
+
+func windowStart(t time.Time, every time.Duration) time.Time {
+	offset := t.UnixNano() % int64(every)
+	if offset < 0 {
+		offset += int64(every)
+	}
+
+	return t.Add(-time.Duration(offset))
+}
+
+func aggregate(points []MeasurementPoint, fn aggregateFunc) float64 {
+	switch fn {
+	case aggregateCount:
+		return float64(len(points))
+	case aggregateLast:
+		return points[len(points)-1].Value
+	case aggregateMin:
+		min := points[0].Value
+		for _, point := range points[1:] {
+			if point.Value < min {
+				min = point.Value
+			}
+		}
+		return min
+	case aggregateMax:
+		max := points[0].Value
+		for _, point := range points[1:] {
+			if point.Value > max {
+				max = point.Value
+			}
+		}
+		return max
+	default:
+		sum := 0.0
+		for _, point := range points {
+			sum += point.Value
+		}
+		return sum / float64(len(points))
+	}
+}
+
+func (db *inMemoryMeasurementReader) inRange(deviceID string, from time.Time, to time.Time) []MeasurementPoint {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	points := make([]MeasurementPoint, 0)
+	for _, point := range db.measurements[deviceID] {
+		if !point.Time.Before(from) && point.Time.Before(to) {
+			points = append(points, point)
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+
+	return points
+}
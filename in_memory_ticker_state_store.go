@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type inMemoryTickerStateStore struct {
+	mu    sync.Mutex
+	state tickerState
+}
+
+func (store *inMemoryTickerStateStore) Load(_ context.Context) (tickerState, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.state, nil
+}
+
+func (store *inMemoryTickerStateStore) Save(_ context.Context, state tickerState) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.state = state
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"time"
+)
+
+type influxMeasurementReader struct {
+	queryAPI api.QueryAPI
+	bucket   string
+}
+
+func (r *influxMeasurementReader) Read(ctx context.Context, deviceID string, from time.Time, to time.Time, limit int) ([]MeasurementPoint, error) {
+	query := r.deviceQuery(deviceID, from, to) + `
+  |> sort(columns: ["_time"])`
+	if limit > 0 {
+		query += fmt.Sprintf(`
+  |> limit(n: %d)`, limit)
+	}
+
+	return r.query(ctx, query)
+}
+
+func (r *influxMeasurementReader) Aggregate(ctx context.Context, deviceID string, from time.Time, to time.Time, every time.Duration, fn aggregateFunc) ([]MeasurementPoint, error) {
+	query := r.deviceQuery(deviceID, from, to) + fmt.Sprintf(`
+  |> aggregateWindow(every: %dns, fn: %s, createEmpty: false)`, every.Nanoseconds(), fn)
+
+	return r.query(ctx, query)
+}
+
+// deviceQuery selects the measurements of a device as a single table. Unit and
+// tags are InfluxDB tags, so a device whose unit or tags changed has several
+// series, and sort, limit and aggregateWindow would work on each separately.
+func (r *influxMeasurementReader) deviceQuery(deviceID string, from time.Time, to time.Time) string {
+	return fmt.Sprintf(`from(bucket: %q)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %q and r._field == %q and r.%s == %q)
+  |> group()`,
+		r.bucket,
+		from.UTC().Format(time.RFC3339Nano),
+		to.UTC().Format(time.RFC3339Nano),
+		measurementName,
+		measurementField,
+		deviceIDTag,
+		deviceID)
+}
+
+func (r *influxMeasurementReader) query(ctx context.Context, query string) ([]MeasurementPoint, error) {
+	result, err := r.queryAPI.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	points := make([]MeasurementPoint, 0)
+	for result.Next() {
+		record := result.Record()
+		value, err := toFloat(record.Value())
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, MeasurementPoint{Time: record.Time(), Value: value})
+	}
+
+	return points, result.Err()
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	default:
+		return 0, fmt.Errorf("unexpected measurement value type %T", value)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestInfluxMeasurementReader_ReadSortsAndLimitsAllSeriesTogether(t *testing.T) {
+	queryAPI := recordingQueryAPI{}
+	underTest := influxMeasurementReader{queryAPI: &queryAPI, bucket: "tsm"}
+	from := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	_, _ = underTest.Read(context.Background(), "device", from, from.Add(time.Hour), 10)
+
+	assert.Equal(t, `from(bucket: "tsm")
+  |> range(start: 2021-01-01T12:00:00Z, stop: 2021-01-01T13:00:00Z)
+  |> filter(fn: (r) => r._measurement == "deviceValues" and r._field == "value" and r.deviceId == "device")
+  |> group()
+  |> sort(columns: ["_time"])
+  |> limit(n: 10)`, queryAPI.query)
+}
+
+func TestInfluxMeasurementReader_AggregateWindowsAllSeriesTogether(t *testing.T) {
+	queryAPI := recordingQueryAPI{}
+	underTest := influxMeasurementReader{queryAPI: &queryAPI, bucket: "tsm"}
+	from := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	_, _ = underTest.Aggregate(context.Background(), "device", from, from.Add(time.Hour), time.Minute, aggregateMean)
+
+	assert.Equal(t, `from(bucket: "tsm")
+  |> range(start: 2021-01-01T12:00:00Z, stop: 2021-01-01T13:00:00Z)
+  |> filter(fn: (r) => r._measurement == "deviceValues" and r._field == "value" and r.deviceId == "device")
+  |> group()
+  |> aggregateWindow(every: 60000000000ns, fn: mean, createEmpty: false)`, queryAPI.query)
+}
+
+// recordingQueryAPI keeps the last Flux query instead of running it.
+type recordingQueryAPI struct {
+	api.QueryAPI
+	query string
+}
+
+func (q *recordingQueryAPI) Query(_ context.Context, query string) (*api.QueryTableResult, error) {
+	q.query = query
+	return nil, errors.New("mock error - query not run")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"time"
+)
+
+// Interval is the time between two measurements of a device. JSON accepts
+// either a Go duration string ("250ms", "1m30s") or a number of milliseconds
+// and always writes a duration string. Mongo stores int64 nanoseconds;
+// documents written before sub-second intervals hold whole seconds as int32
+// and are still read as seconds.
+type Interval time.Duration
+
+func (i Interval) Duration() time.Duration {
+	return time.Duration(i)
+}
+
+func (i Interval) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.Duration().String())
+}
+
+func (i *Interval) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("interval: %w", err)
+		}
+
+		*i = Interval(d)
+		return nil
+	}
+
+	var ms float64
+	if err := json.Unmarshal(data, &ms); err != nil {
+		return fmt.Errorf("interval has to be a duration string or a number of milliseconds")
+	}
+
+	*i = Interval(ms * float64(time.Millisecond))
+	return nil
+}
+
+func (i Interval) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(int64(i))
+}
+
+func (i *Interval) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: t, Value: data}
+
+	if ns, ok := value.Int64OK(); ok {
+		*i = Interval(ns)
+		return nil
+	}
+
+	if seconds, ok := value.Int32OK(); ok {
+		*i = Interval(time.Duration(seconds) * time.Second)
+		return nil
+	}
+
+	if seconds, ok := value.DoubleOK(); ok {
+		*i = Interval(seconds * float64(time.Second))
+		return nil
+	}
+
+	return fmt.Errorf("cannot decode %v into an interval", t)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+	"time"
+)
+
+func TestInterval_UnmarshalJSON(t *testing.T) {
+	testCases := map[string]time.Duration{
+		`"250ms"`:  250 * time.Millisecond,
+		`"1m30s"`:  90 * time.Second,
+		`1500`:     1500 * time.Millisecond,
+		`0.5`:      500 * time.Microsecond,
+		`"-1s"`:    -time.Second,
+		`"1h2m3s"`: time.Hour + 2*time.Minute + 3*time.Second,
+	}
+
+	for data, expected := range testCases {
+		t.Run(data, func(t *testing.T) {
+			var underTest Interval
+
+			err := json.Unmarshal([]byte(data), &underTest)
+
+			require.NoError(t, err)
+			assert.Equal(t, expected, underTest.Duration())
+		})
+	}
+}
+
+func TestInterval_UnmarshalJSON_Invalid(t *testing.T) {
+	for _, data := range []string{`"fast"`, `"10"`, `true`, `{}`} {
+		t.Run(data, func(t *testing.T) {
+			var underTest Interval
+
+			assert.Error(t, json.Unmarshal([]byte(data), &underTest))
+		})
+	}
+}
+
+func TestInterval_MarshalJSON(t *testing.T) {
+	data, err := json.Marshal(Interval(1500 * time.Millisecond))
+
+	require.NoError(t, err)
+	assert.Equal(t, `"1.5s"`, string(data))
+}
+
+func TestInterval_BSONRoundTrip(t *testing.T) {
+	device := Device{Name: "device", Interval: Interval(250 * time.Millisecond)}
+
+	data, err := bson.Marshal(device)
+	require.NoError(t, err)
+
+	var stored bson.M
+	require.NoError(t, bson.Unmarshal(data, &stored))
+	assert.Equal(t, int64(250*time.Millisecond), stored["interval"])
+
+	var result Device
+	require.NoError(t, bson.Unmarshal(data, &result))
+	assert.Equal(t, device.Interval, result.Interval)
+}
+
+func TestInterval_UnmarshalBSON_LegacySeconds(t *testing.T) {
+	testCases := map[string]interface{}{
+		"int32":  int32(5),
+		"double": 5.0,
+	}
+
+	for name, legacy := range testCases {
+		t.Run(name, func(t *testing.T) {
+			data, err := bson.Marshal(bson.M{"name": "device", "interval": legacy})
+			require.NoError(t, err)
+
+			var result Device
+			require.NoError(t, bson.Unmarshal(data, &result))
+
+			assert.Equal(t, 5*time.Second, result.Interval.Duration())
+		})
+	}
+}
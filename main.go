@@ -2,13 +2,25 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/gorilla/mux"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	influxOrg    = "tsm"
+	influxBucket = "mydb"
 )
 
 func main() {
@@ -18,7 +30,13 @@ func main() {
 	}
 
 	client := influxdb2.NewClient(os.Getenv("TSM_INFLUX_URL"), os.Getenv("TSM_INFLUX_TOKEN"))
-	mw := MeasurementsWriter{rf: rabbit.CreateReceiver, writeAPI: client.WriteAPIBlocking("tsm", "mydb")}
+	mw := MeasurementsWriter{
+		rf:            rabbit.CreateReceiver,
+		writeAPI:      client.WriteAPIBlocking(influxOrg, influxBucket),
+		batchSize:     getEnvInt("TSM_INFLUX_BATCH_SIZE", 100),
+		flushInterval: getEnvDuration("TSM_INFLUX_FLUSH_INTERVAL", time.Second),
+		errorHandler:  reportMeasurementsWriterError,
+	}
 
 	if err = mw.AsyncStart(); err != nil {
 		panic(err)
@@ -30,22 +48,138 @@ func main() {
 	}
 
 	myRouter := mux.NewRouter().StrictSlash(true)
+	myRouter.NotFoundHandler = http.HandlerFunc(notFound)
+	myRouter.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	myRouter.Use(metricsMiddleware)
+	myRouter.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
 
 	mongodb := m.Database("tsm")
-	dao := mongoDeviceDAO{db: mongodb}
-	deviceService := DeviceService{dao: &dao}
+	dao := mongoDeviceDAO{db: mongodb, uniqueNamePerTenant: getEnvBool("TSM_UNIQUE_NAME_PER_TENANT", false)}
+	if migrated, err := dao.MigrateIntervals(context.Background()); err != nil {
+		panic(err)
+	} else if migrated > 0 {
+		log.Printf("migrated interval of %d devices from seconds to nanoseconds", migrated)
+	}
+	if migrated, err := dao.MigrateAuditFields(context.Background()); err != nil {
+		panic(err)
+	} else if migrated > 0 {
+		log.Printf("stamped %d devices with createdAt, updatedAt and version", migrated)
+	}
+	if err := dao.EnsureIndexes(context.Background()); err != nil {
+		panic(err)
+	}
+	deviceService := DeviceService{dao: &dao, replay: newReplayStore(os.Getenv("TSM_REPLAY_DIR"))}
+
+	tickerHandler := newTickerHTTPHandler(&deviceService, rabbit.Publish, &mongoTickerStateStore{db: mongodb})
+	myRouter.HandleFunc("/start", tickerHandler.Start).Methods(http.MethodPost)
+	myRouter.HandleFunc("/stop", tickerHandler.Stop).Methods(http.MethodPost)
+	myRouter.HandleFunc("/devices/{id}/start", tickerHandler.StartDevice).Methods(http.MethodPost)
+	myRouter.HandleFunc("/devices/{id}/stop", tickerHandler.StopDevice).Methods(http.MethodPost)
+	myRouter.HandleFunc("/ticker", tickerHandler.GetStatus).Methods(http.MethodGet)
+	myRouter.HandleFunc("/devices/{id}/ticker", tickerHandler.GetDeviceStatus).Methods(http.MethodGet)
 
-	deviceHandler := deviceHTTPHandler{service: &deviceService}
+	deviceHandler := deviceHTTPHandler{service: &deviceService, status: tickerHandler.ts}
 	myRouter.HandleFunc("/devices", deviceHandler.createDevice).Methods(http.MethodPost)
 	myRouter.HandleFunc("/devices/{id}", deviceHandler.getByID).Methods(http.MethodGet)
 	myRouter.HandleFunc("/devices", deviceHandler.getAll).Methods(http.MethodGet)
+	myRouter.HandleFunc("/devices:bulk", deviceHandler.importDevices).Methods(http.MethodPost)
+	myRouter.HandleFunc("/devices:export", deviceHandler.exportDevices).Methods(http.MethodGet)
+	myRouter.HandleFunc("/devices/{id}", deviceHandler.updateDevice).Methods(http.MethodPut)
+	myRouter.HandleFunc("/devices/{id}", deviceHandler.patchDevice).Methods(http.MethodPatch)
+	myRouter.HandleFunc("/devices/{id}", deviceHandler.deleteDevice).Methods(http.MethodDelete)
 
-	tickerHandler := newTickerHTTPHandler(&deviceService, rabbit.Publish)
-	myRouter.HandleFunc("/start", tickerHandler.Start).Methods(http.MethodPost)
-	myRouter.HandleFunc("/stop", tickerHandler.Stop).Methods(http.MethodPost)
+	measurementHandler := measurementHTTPHandler{
+		devices: &deviceService,
+		reader:  &influxMeasurementReader{queryAPI: client.QueryAPI(influxOrg), bucket: influxBucket},
+	}
+	myRouter.HandleFunc("/devices/{id}/measurements", measurementHandler.getMeasurements).Methods(http.MethodGet)
+	myRouter.HandleFunc("/devices/{id}/measurements/aggregate", measurementHandler.getAggregate).Methods(http.MethodGet)
 
+	deadLetterHandler := deadLetterHTTPHandler{store: rabbit}
+	myRouter.HandleFunc("/admin/dead-letters", deadLetterHandler.getDeadLetters).Methods(http.MethodGet)
+	myRouter.HandleFunc("/admin/dead-letters/replay", deadLetterHandler.replay).Methods(http.MethodPost)
+
+	healthHandler := healthHTTPHandler{checks: []healthCheck{
+		{name: "mongo", check: func(ctx context.Context) error {
+			if err := m.Ping(ctx, nil); err != nil {
+				return err
+			}
+			return dao.Ready(ctx)
+		}},
+		{name: "rabbitmq", check: rabbit.Ready},
+		{name: "influxdb", check: func(ctx context.Context) error { return influxReady(ctx, client) }},
+	}}
+	myRouter.HandleFunc("/healthz", healthHandler.liveness).Methods(http.MethodGet)
+	myRouter.HandleFunc("/readyz", healthHandler.readiness).Methods(http.MethodGet)
+
+	if err := tickerHandler.ts.Restore(context.Background()); err != nil {
+		log.Printf("failed to restore ticker state: %v", err)
+	}
+
+	server := &http.Server{Addr: getAddr(), Handler: myRouter}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
 	log.Printf("tsm started and listening on %v", getAddr())
-	log.Fatal(http.ListenAndServe(getAddr(), myRouter))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case sig := <-signals:
+		log.Printf("received %v, shutting down", sig)
+	case err := <-serverErr:
+		log.Print(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), getEnvDuration("TSM_SHUTDOWN_TIMEOUT", 10*time.Second))
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Print(err)
+	}
+
+	tickerHandler.ts.Shutdown()
+
+	if err := rabbit.StopConsuming(); err != nil {
+		log.Print(err)
+	}
+
+	if err := mw.Wait(ctx); err != nil {
+		log.Printf("measurements not drained: %v", err)
+	}
+
+	if err := rabbit.Close(); err != nil {
+		log.Print(err)
+	}
+
+	// the drain may have used up the shutdown timeout, Mongo gets its own
+	disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelDisconnect()
+
+	if err := m.Disconnect(disconnectCtx); err != nil {
+		log.Print(err)
+	}
+
+	client.Close()
+	log.Print("tsm stopped")
+}
+
+func influxReady(ctx context.Context, client influxdb2.Client) error {
+	health, err := client.Health(ctx)
+	if err != nil {
+		return err
+	}
+
+	if health.Status != domain.HealthCheckStatusPass {
+		if health.Message != nil {
+			return fmt.Errorf("influxdb status %v: %v", health.Status, *health.Message)
+		}
+		return fmt.Errorf("influxdb status %v", health.Status)
+	}
+
+	return nil
 }
 
 func getAddr() string {
@@ -57,3 +191,42 @@ func getAddr() string {
 
 	return ":8000"
 }
+
+func getEnvDuration(name string, defVal time.Duration) time.Duration {
+	value := os.Getenv(name)
+
+	if value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("invalid %v %q, using default %v", name, value, defVal)
+	}
+
+	return defVal
+}
+
+func getEnvBool(name string, defVal bool) bool {
+	value := os.Getenv(name)
+
+	if value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+		log.Printf("invalid %v %q, using default %v", name, value, defVal)
+	}
+
+	return defVal
+}
+
+func getEnvInt(name string, defVal int) int {
+	value := os.Getenv(name)
+
+	if value != "" {
+		if i, err := strconv.Atoi(value); err == nil && i > 0 {
+			return i
+		}
+		log.Printf("invalid %v %q, using default %v", name, value, defVal)
+	}
+
+	return defVal
+}
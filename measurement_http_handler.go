@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMeasurementsRange = time.Hour
+	defaultAggregateWindow   = time.Minute
+	maxAggregateWindows      = 10000
+	maxMeasurementsPerPage   = 10000
+)
+
+type aggregateFunc string
+
+const (
+	aggregateMean  aggregateFunc = "mean"
+	aggregateMin   aggregateFunc = "min"
+	aggregateMax   aggregateFunc = "max"
+	aggregateLast  aggregateFunc = "last"
+	aggregateCount aggregateFunc = "count"
+)
+
+type MeasurementPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type measurementReader interface {
+	Read(ctx context.Context, deviceID string, from time.Time, to time.Time, limit int) ([]MeasurementPoint, error)
+	Aggregate(ctx context.Context, deviceID string, from time.Time, to time.Time, every time.Duration, fn aggregateFunc) ([]MeasurementPoint, error)
+}
+
+type measurementHTTPHandler struct {
+	devices *DeviceService
+	reader  measurementReader
+}
+
+func (h *measurementHTTPHandler) getMeasurements(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	params := r.URL.Query()
+
+	from, to, err := h.getTimeRange(params.Get("from"), params.Get("to"))
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := h.getLimit(params.Get("limit"))
+	if err != nil || limit < 1 || limit > maxMeasurementsPerPage {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be a number between 1 and %d", maxMeasurementsPerPage))
+		return
+	}
+
+	if !h.deviceExists(w, r, id) {
+		return
+	}
+
+	points, err := h.reader.Read(r.Context(), id, from, to, limit)
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusInternalServerError, "failed to read measurements")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(points); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *measurementHTTPHandler) getAggregate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	params := r.URL.Query()
+
+	from, to, err := h.getTimeRange(params.Get("from"), params.Get("to"))
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	every, err := h.getWindow(params.Get("every"), to.Sub(from))
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fn, err := h.getAggregateFunc(params.Get("fn"))
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !h.deviceExists(w, r, id) {
+		return
+	}
+
+	points, err := h.reader.Aggregate(r.Context(), id, from, to, every, fn)
+	if err != nil {
+		log.Print(err)
+		writeProblem(w, r, http.StatusInternalServerError, "failed to aggregate measurements")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(points); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *measurementHTTPHandler) deviceExists(w http.ResponseWriter, r *http.Request, id string) bool {
+	if _, err := h.devices.GetByID(r.Context(), id); err != nil {
+		log.Print(err)
+		writeError(w, r, err)
+		return false
+	}
+
+	return true
+}
+
+func (h *measurementHTTPHandler) getTimeRange(fromParam string, toParam string) (time.Time, time.Time, error) {
+	to := time.Now()
+	if toParam != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, toParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("to must be a RFC 3339 timestamp: %w", err)
+		}
+		to = parsed
+	}
+
+	from := to.Add(-defaultMeasurementsRange)
+	if fromParam != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, fromParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("from must be a RFC 3339 timestamp: %w", err)
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from has to be before to")
+	}
+
+	return from, to, nil
+}
+
+func (h *measurementHTTPHandler) getWindow(param string, timeRange time.Duration) (time.Duration, error) {
+	if param == "" {
+		return h.defaultWindow(timeRange), nil
+	}
+
+	every, err := time.ParseDuration(param)
+	if err != nil || every <= 0 {
+		return 0, fmt.Errorf("every must be a positive duration, e.g. 30s or 1m")
+	}
+
+	if timeRange/every > maxAggregateWindows {
+		return 0, fmt.Errorf("every is too small for requested range, at most %d windows are allowed", maxAggregateWindows)
+	}
+
+	return every, nil
+}
+
+// defaultWindow is defaultAggregateWindow, widened to whole seconds when the
+// range would otherwise have more than maxAggregateWindows windows.
+func (h *measurementHTTPHandler) defaultWindow(timeRange time.Duration) time.Duration {
+	if timeRange/defaultAggregateWindow <= maxAggregateWindows {
+		return defaultAggregateWindow
+	}
+
+	every := (timeRange + maxAggregateWindows - 1) / maxAggregateWindows
+	if every%time.Second != 0 {
+		every = every.Truncate(time.Second) + time.Second
+	}
+
+	return every
+}
+
+func (h *measurementHTTPHandler) getAggregateFunc(param string) (aggregateFunc, error) {
+	if param == "" {
+		return aggregateMean, nil
+	}
+
+	switch fn := aggregateFunc(param); fn {
+	case aggregateMean, aggregateMin, aggregateMax, aggregateLast, aggregateCount:
+		return fn, nil
+	default:
+		return "", fmt.Errorf("fn must be one of: mean, min, max, last, count")
+	}
+}
+
+func (h *measurementHTTPHandler) getLimit(param string) (int, error) {
+	if param == "" {
+		return 100, nil
+	}
+
+	return strconv.Atoi(param)
+}
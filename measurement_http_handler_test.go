@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetMeasurementsReturnsPointsInRange(t *testing.T) {
+	id := primitive.NewObjectID()
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := inMemoryMeasurementReader{measurements: map[string][]MeasurementPoint{
+		id.Hex(): {
+			{Time: start.Add(2 * time.Second), Value: 3},
+			{Time: start, Value: 1},
+			{Time: start.Add(time.Second), Value: 2},
+			{Time: start.Add(time.Minute), Value: 4},
+		},
+	}}
+	req := createMeasurementsRequest(id.Hex(), map[string]string{
+		"from":  "2021-01-01T12:00:00Z",
+		"to":    "2021-01-01T12:00:30Z",
+		"limit": "2",
+	})
+	res := httptest.NewRecorder()
+	underTest := newTestMeasurementHTTPHandler(id, &reader)
+
+	underTest.getMeasurements(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, `[{"time":"2021-01-01T12:00:00Z","value":1},{"time":"2021-01-01T12:00:01Z","value":2}]`, res.Body.String())
+}
+
+func TestGetMeasurementsBadRequestParameters(t *testing.T) {
+	testCases := map[string]map[string]string{
+		"limit negative":    {"limit": "-1"},
+		"limit zero":        {"limit": "0"},
+		"limit above max":   {"limit": "10001"},
+		"limit string":      {"limit": "string"},
+		"from not RFC 3339": {"from": "yesterday"},
+		"to not RFC 3339":   {"to": "1609502400"},
+		"from after to":     {"from": "2021-01-01T13:00:00Z", "to": "2021-01-01T12:00:00Z"},
+	}
+
+	id := primitive.NewObjectID()
+	underTest := newTestMeasurementHTTPHandler(id, &inMemoryMeasurementReader{})
+
+	for name, params := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := createMeasurementsRequest(id.Hex(), params)
+			res := httptest.NewRecorder()
+
+			underTest.getMeasurements(res, req)
+
+			assert.Equal(t, http.StatusBadRequest, res.Code)
+		})
+	}
+}
+
+func TestGetMeasurementsDeviceNotFound(t *testing.T) {
+	req := createMeasurementsRequest(primitive.NewObjectID().Hex(), nil)
+	res := httptest.NewRecorder()
+	underTest := newTestMeasurementHTTPHandler(primitive.NewObjectID(), &inMemoryMeasurementReader{})
+
+	underTest.getMeasurements(res, req)
+
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestGetMeasurementsReaderError(t *testing.T) {
+	id := primitive.NewObjectID()
+	req := createMeasurementsRequest(id.Hex(), nil)
+	res := httptest.NewRecorder()
+	underTest := newTestMeasurementHTTPHandler(id, &failingMeasurementReader{})
+
+	underTest.getMeasurements(res, req)
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+}
+
+func TestGetAggregateComputesEveryFunction(t *testing.T) {
+	id := primitive.NewObjectID()
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := inMemoryMeasurementReader{measurements: map[string][]MeasurementPoint{
+		id.Hex(): {
+			{Time: start.Add(10 * time.Second), Value: 4},
+			{Time: start.Add(20 * time.Second), Value: 2},
+			{Time: start.Add(50 * time.Second), Value: 6},
+			{Time: start.Add(70 * time.Second), Value: 8},
+		},
+	}}
+	testCases := map[aggregateFunc]string{
+		aggregateMean:  `[{"time":"2021-01-01T12:01:00Z","value":4},{"time":"2021-01-01T12:01:30Z","value":8}]`,
+		aggregateMin:   `[{"time":"2021-01-01T12:01:00Z","value":2},{"time":"2021-01-01T12:01:30Z","value":8}]`,
+		aggregateMax:   `[{"time":"2021-01-01T12:01:00Z","value":6},{"time":"2021-01-01T12:01:30Z","value":8}]`,
+		aggregateLast:  `[{"time":"2021-01-01T12:01:00Z","value":6},{"time":"2021-01-01T12:01:30Z","value":8}]`,
+		aggregateCount: `[{"time":"2021-01-01T12:01:00Z","value":3},{"time":"2021-01-01T12:01:30Z","value":1}]`,
+	}
+
+	underTest := newTestMeasurementHTTPHandler(id, &reader)
+
+	for fn, expected := range testCases {
+		t.Run(string(fn), func(t *testing.T) {
+			req := createMeasurementsRequest(id.Hex(), map[string]string{
+				"from":  "2021-01-01T12:00:00Z",
+				"to":    "2021-01-01T12:01:30Z",
+				"every": "1m",
+				"fn":    string(fn),
+			})
+			res := httptest.NewRecorder()
+
+			underTest.getAggregate(res, req)
+
+			assert.Equal(t, http.StatusOK, res.Code)
+			require.JSONEq(t, expected, res.Body.String())
+		})
+	}
+}
+
+func TestGetAggregateBadRequestParameters(t *testing.T) {
+	testCases := map[string]map[string]string{
+		"unknown fn":       {"fn": "median"},
+		"every not parsed": {"every": "minute"},
+		"every negative":   {"every": "-1m"},
+		"too many windows": {"from": "2021-01-01T00:00:00Z", "to": "2021-01-02T00:00:00Z", "every": "1s"},
+	}
+
+	id := primitive.NewObjectID()
+	underTest := newTestMeasurementHTTPHandler(id, &inMemoryMeasurementReader{})
+
+	for name, params := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := createMeasurementsRequest(id.Hex(), params)
+			res := httptest.NewRecorder()
+
+			underTest.getAggregate(res, req)
+
+			assert.Equal(t, http.StatusBadRequest, res.Code)
+		})
+	}
+}
+
+func TestGetAggregateDefaultWindowFitsRange(t *testing.T) {
+	testCases := map[time.Duration]time.Duration{
+		time.Hour:           time.Minute,
+		6 * 24 * time.Hour:  time.Minute,
+		7 * 24 * time.Hour:  61 * time.Second,
+		30 * 24 * time.Hour: 260 * time.Second,
+	}
+
+	underTest := measurementHTTPHandler{}
+
+	for timeRange, expected := range testCases {
+		every, err := underTest.getWindow("", timeRange)
+
+		assert.NoError(t, err)
+		assert.Equal(t, expected, every)
+		assert.LessOrEqual(t, int64(timeRange/every), int64(maxAggregateWindows))
+	}
+}
+
+func newTestMeasurementHTTPHandler(id primitive.ObjectID, reader measurementReader) measurementHTTPHandler {
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "device", Interval: Interval(time.Second)}}}
+	return measurementHTTPHandler{devices: &DeviceService{dao: &dao}, reader: reader}
+}
+
+func createMeasurementsRequest(id string, params map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/devices/%v/measurements", id), nil)
+	query := req.URL.Query()
+	for key, value := range params {
+		query.Add(key, value)
+	}
+	req.URL.RawQuery = query.Encode()
+	req = mux.SetURLVars(req, map[string]string{
+		"id": id,
+	})
+	return req
+}
+
+type failingMeasurementReader struct {
+}
+
+func (r *failingMeasurementReader) Read(_ context.Context, _ string, _ time.Time, _ time.Time, _ int) ([]MeasurementPoint, error) {
+	return nil, errors.New("mock error - failed to read measurements")
+}
+
+func (r *failingMeasurementReader) Aggregate(_ context.Context, _ string, _ time.Time, _ time.Time, _ time.Duration, _ aggregateFunc) ([]MeasurementPoint, error) {
+	return nil, errors.New("mock error - failed to aggregate measurements")
+}
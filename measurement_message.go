@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	measurementMessageVersion = 1
+
+	contentTypeJSON      = "application/json"
+	contentTypeTextPlain = "text/plain"
+)
+
+// measurementMessage is the payload published on the measurements exchange.
+// Bump measurementMessageVersion on incompatible changes; consumers reject
+// versions they don't know.
+type measurementMessage struct {
+	Version     int               `json:"v"`
+	DeviceID    string            `json:"deviceId"`
+	Value       float64           `json:"value"`
+	GeneratedAt time.Time         `json:"generatedAt"`
+	Seq         uint64            `json:"seq"`
+	Unit        string            `json:"unit,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+func encodeMeasurement(m Measurement) ([]byte, error) {
+	return json.Marshal(measurementMessage{
+		Version:     measurementMessageVersion,
+		DeviceID:    m.Id,
+		Value:       m.Value,
+		GeneratedAt: m.Time,
+		Seq:         m.Seq,
+		Unit:        m.Unit,
+		Tags:        m.Tags,
+	})
+}
+
+// decodeMeasurement reads a measurement published either as JSON or, by
+// publishers older than the JSON format, as a plain text float. Legacy
+// measurements carry no generation time, so Time is left zero.
+func decodeMeasurement(contentType string, routingKey string, body []byte) (Measurement, error) {
+	switch mediaType(contentType) {
+	case contentTypeJSON:
+		var msg measurementMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return Measurement{}, err
+		}
+
+		if msg.Version != measurementMessageVersion {
+			return Measurement{}, fmt.Errorf("unsupported measurement message version %d", msg.Version)
+		}
+
+		if msg.DeviceID == "" {
+			msg.DeviceID = routingKey
+		}
+
+		return Measurement{Id: msg.DeviceID, Value: msg.Value, Time: msg.GeneratedAt, Seq: msg.Seq, Unit: msg.Unit, Tags: msg.Tags}, nil
+	case contentTypeTextPlain, "":
+		value, err := strconv.ParseFloat(string(body), 64)
+		if err != nil {
+			return Measurement{}, err
+		}
+
+		return Measurement{Id: routingKey, Value: value}, nil
+	default:
+		return Measurement{}, fmt.Errorf("unsupported measurement content type %q", contentType)
+	}
+}
+
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestEncodeMeasurement(t *testing.T) {
+	m := Measurement{Id: "device", Value: 1.23456789, Time: time.Date(2021, 1, 1, 12, 0, 0, 250000000, time.UTC), Seq: 7, Unit: "°C"}
+
+	body, err := encodeMeasurement(m)
+
+	require.NoError(t, err)
+	require.JSONEq(t, `{"v":1,"deviceId":"device","value":1.23456789,"generatedAt":"2021-01-01T12:00:00.25Z","seq":7,"unit":"°C"}`, string(body))
+}
+
+func TestDecodeMeasurementRoundTrip(t *testing.T) {
+	m := Measurement{Id: "device", Value: 1.23456789, Time: time.Date(2021, 1, 1, 12, 0, 0, 250000000, time.UTC), Seq: 7, Tags: map[string]string{"site": "krk"}}
+	body, _ := encodeMeasurement(m)
+
+	result, err := decodeMeasurement("application/json; charset=utf-8", "device", body)
+
+	require.NoError(t, err)
+	assert.Equal(t, m, result)
+}
+
+func TestDecodeMeasurementLegacyTextPlain(t *testing.T) {
+	result, err := decodeMeasurement("text/plain", "device", []byte("5.000000"))
+
+	require.NoError(t, err)
+	assert.Equal(t, Measurement{Id: "device", Value: 5}, result)
+}
+
+func TestDecodeMeasurementInvalidPayloads(t *testing.T) {
+	testCases := map[string]struct {
+		contentType string
+		body        string
+	}{
+		"text not a number":   {contentType: "text/plain", body: "five"},
+		"json malformed":      {contentType: "application/json", body: `{"v":1,`},
+		"json wrong version":  {contentType: "application/json", body: `{"v":2,"deviceId":"device","value":1}`},
+		"unknown contentType": {contentType: "application/xml", body: "<value>1</value>"},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := decodeMeasurement(testCase.contentType, "device", []byte(testCase.body))
+
+			assert.Error(t, err)
+		})
+	}
+}
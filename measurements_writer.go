@@ -2,22 +2,60 @@ package main
 
 import (
 	"context"
+	"fmt"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"log"
 	"time"
 )
 
+const (
+	measurementName  = "deviceValues"
+	measurementField = "value"
+	deviceIDTag      = "deviceId"
+	unitTag          = "unit"
+
+	defaultFlushInterval = time.Second
+)
+
+// deliveryAcknowledger confirms that a received measurement has been handled.
+// Nack reports a failed write; the implementation decides whether the
+// measurement is delivered again.
+type deliveryAcknowledger interface {
+	Ack() error
+	Nack(reason error) error
+}
+
 type Measurement struct {
 	Id    string
 	Value float64
+	Time  time.Time
+	Seq   uint64
+	Unit  string
+	Tags  map[string]string
+	ack   deliveryAcknowledger
+}
+
+type pendingPoint struct {
+	measurement Measurement
+	point       *write.Point
 }
 
 type receiverFactory func() (<-chan Measurement, error)
 
+// MeasurementsWriter stores received measurements in InfluxDB. Points are
+// buffered and written in batches once batchSize points are collected or
+// flushInterval elapses, whichever comes first. The remaining buffer is
+// flushed when the receiver channel is closed. Measurements are acknowledged
+// only after the batch containing them has been written.
 type MeasurementsWriter struct {
-	rf       receiverFactory
-	writeAPI api.WriteAPIBlocking
+	rf            receiverFactory
+	writeAPI      api.WriteAPIBlocking
+	batchSize     int
+	flushInterval time.Duration
+	errorHandler  func(err error)
+	done          chan struct{}
 }
 
 func (mw *MeasurementsWriter) AsyncStart() error {
@@ -26,18 +64,141 @@ func (mw *MeasurementsWriter) AsyncStart() error {
 		return err
 	}
 
+	mw.done = make(chan struct{})
+
 	go func() {
-		for m := range measurements {
-			point := influxdb2.NewPointWithMeasurement("deviceValues").
-				AddTag("deviceId", m.Id).
-				AddField("value", m.Value).
-				SetTime(time.Now().Round(time.Second))
-
-			if writeErr := mw.writeAPI.WritePoint(context.Background(), point); writeErr != nil {
-				log.Print(writeErr)
-			}
-		}
+		defer close(mw.done)
+		mw.writeBatches(measurements)
 	}()
 
 	return nil
 }
+
+func (mw *MeasurementsWriter) writeBatches(measurements <-chan Measurement) {
+	batchSize := mw.batchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	flushInterval := mw.flushInterval
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+
+	batch := make([]pendingPoint, 0, batchSize)
+	for {
+		select {
+		case m, ok := <-measurements:
+			if !ok {
+				mw.write(batch)
+				return
+			}
+
+			timestamp := m.Time
+			if timestamp.IsZero() {
+				timestamp = time.Now()
+			}
+
+			batch = append(batch, pendingPoint{measurement: m, point: newMeasurementPoint(m, timestamp)})
+
+			if len(batch) >= batchSize {
+				mw.write(batch)
+				batch = make([]pendingPoint, 0, batchSize)
+			}
+		case <-flush.C:
+			if len(batch) > 0 {
+				mw.write(batch)
+				batch = make([]pendingPoint, 0, batchSize)
+			}
+		}
+	}
+}
+
+// newMeasurementPoint tags the point with the device id, the unit and the
+// device tags, so Flux queries can group series by site or type. Device tags
+// can't replace the device id, even when published by an older version.
+func newMeasurementPoint(m Measurement, timestamp time.Time) *write.Point {
+	point := influxdb2.NewPointWithMeasurement(measurementName).
+		AddTag(deviceIDTag, m.Id).
+		AddField(measurementField, m.Value).
+		SetTime(timestamp)
+
+	if m.Unit != "" {
+		point.AddTag(unitTag, m.Unit)
+	}
+
+	for key, value := range m.Tags {
+		if key != deviceIDTag && key != unitTag {
+			point.AddTag(key, value)
+		}
+	}
+
+	return point
+}
+
+func (mw *MeasurementsWriter) write(batch []pendingPoint) {
+	if len(batch) == 0 {
+		return
+	}
+
+	points := make([]*write.Point, 0, len(batch))
+	for _, p := range batch {
+		points = append(points, p.point)
+	}
+
+	start := time.Now()
+	writeErr := mw.writeAPI.WritePoint(context.Background(), points...)
+	influxWriteDuration.Observe(time.Since(start).Seconds())
+
+	if writeErr != nil {
+		influxWriteFailuresTotal.Inc()
+		mw.reportError(fmt.Errorf("failed to write %d measurements: %w", len(batch), writeErr))
+	} else {
+		influxPointsWrittenTotal.Add(float64(len(points)))
+	}
+
+	for _, p := range batch {
+		if err := mw.acknowledge(p.measurement, writeErr); err != nil {
+			mw.reportError(fmt.Errorf("failed to acknowledge measurement of device %v: %w", p.measurement.Id, err))
+		}
+	}
+}
+
+func (mw *MeasurementsWriter) acknowledge(m Measurement, writeErr error) error {
+	if m.ack == nil {
+		return nil
+	}
+
+	if writeErr != nil {
+		return m.ack.Nack(writeErr)
+	}
+
+	return m.ack.Ack()
+}
+
+func (mw *MeasurementsWriter) reportError(err error) {
+	if mw.errorHandler != nil {
+		mw.errorHandler(err)
+		return
+	}
+
+	log.Print(err)
+}
+
+// Wait blocks until every measurement from the receiver has been written,
+// that is until the receiver channel is closed and drained, or ctx is done.
+func (mw *MeasurementsWriter) Wait(ctx context.Context) error {
+	if mw.done == nil {
+		return nil
+	}
+
+	select {
+	case <-mw.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
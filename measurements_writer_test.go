@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMeasurementsWriter_Wait_ReturnsAfterReceiverDrained(t *testing.T) {
+	measurements := make(chan Measurement, 2)
+	measurements <- Measurement{Id: "first", Value: 1}
+	measurements <- Measurement{Id: "second", Value: 2}
+	close(measurements)
+	writeAPI := recordingWriteAPI{}
+
+	underTest := MeasurementsWriter{
+		rf:       func() (<-chan Measurement, error) { return measurements, nil },
+		writeAPI: &writeAPI,
+	}
+	require.NoError(t, underTest.AsyncStart())
+
+	err := underTest.Wait(context.Background())
+
+	assert.NoError(t, err)
+	assert.Len(t, writeAPI.written(), 2)
+}
+
+func TestMeasurementsWriter_Wait_DeadlineExceeded(t *testing.T) {
+	measurements := make(chan Measurement)
+	defer close(measurements)
+
+	underTest := MeasurementsWriter{
+		rf:       func() (<-chan Measurement, error) { return measurements, nil },
+		writeAPI: &recordingWriteAPI{},
+	}
+	require.NoError(t, underTest.AsyncStart())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := underTest.Wait(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestMeasurementsWriter_FlushesFullBatches(t *testing.T) {
+	measurements := make(chan Measurement, 5)
+	for i := 0; i < 5; i++ {
+		measurements <- Measurement{Id: "device", Value: float64(i)}
+	}
+	close(measurements)
+	writeAPI := recordingWriteAPI{}
+
+	underTest := MeasurementsWriter{
+		rf:            func() (<-chan Measurement, error) { return measurements, nil },
+		writeAPI:      &writeAPI,
+		batchSize:     2,
+		flushInterval: time.Hour,
+	}
+	require.NoError(t, underTest.AsyncStart())
+	require.NoError(t, underTest.Wait(context.Background()))
+
+	assert.Equal(t, []int{2, 2, 1}, writeAPI.batchSizes())
+}
+
+func TestMeasurementsWriter_FlushesPartialBatchAfterInterval(t *testing.T) {
+	measurements := make(chan Measurement)
+	defer close(measurements)
+	writeAPI := recordingWriteAPI{}
+
+	underTest := MeasurementsWriter{
+		rf:            func() (<-chan Measurement, error) { return measurements, nil },
+		writeAPI:      &writeAPI,
+		batchSize:     100,
+		flushInterval: 10 * time.Millisecond,
+	}
+	require.NoError(t, underTest.AsyncStart())
+
+	measurements <- Measurement{Id: "device", Value: 1}
+
+	assert.Eventually(t, func() bool { return len(writeAPI.written()) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestMeasurementsWriter_ReportsWriteErrors(t *testing.T) {
+	measurements := make(chan Measurement, 1)
+	measurements <- Measurement{Id: "device", Value: 1}
+	close(measurements)
+	var reported []error
+
+	underTest := MeasurementsWriter{
+		rf:           func() (<-chan Measurement, error) { return measurements, nil },
+		writeAPI:     &recordingWriteAPI{err: errors.New("mock error - influx unavailable")},
+		errorHandler: func(err error) { reported = append(reported, err) },
+	}
+	require.NoError(t, underTest.AsyncStart())
+	require.NoError(t, underTest.Wait(context.Background()))
+
+	require.Len(t, reported, 1)
+	assert.EqualError(t, reported[0], "failed to write 1 measurements: mock error - influx unavailable")
+}
+
+func TestMeasurementsWriter_AcksWrittenMeasurements(t *testing.T) {
+	ack := recordingAcknowledger{}
+	measurements := make(chan Measurement, 1)
+	measurements <- Measurement{Id: "device", Value: 1, ack: &ack}
+	close(measurements)
+
+	underTest := MeasurementsWriter{
+		rf:       func() (<-chan Measurement, error) { return measurements, nil },
+		writeAPI: &recordingWriteAPI{},
+	}
+	require.NoError(t, underTest.AsyncStart())
+	require.NoError(t, underTest.Wait(context.Background()))
+
+	assert.Equal(t, 1, ack.acked)
+	assert.Empty(t, ack.nacked)
+}
+
+func TestMeasurementsWriter_NacksMeasurementsWhenWriteFails(t *testing.T) {
+	writeErr := errors.New("mock error - influx unavailable")
+	ack := recordingAcknowledger{}
+	measurements := make(chan Measurement, 1)
+	measurements <- Measurement{Id: "device", Value: 1, ack: &ack}
+	close(measurements)
+
+	underTest := MeasurementsWriter{
+		rf:           func() (<-chan Measurement, error) { return measurements, nil },
+		writeAPI:     &recordingWriteAPI{err: writeErr},
+		errorHandler: func(error) {},
+	}
+	require.NoError(t, underTest.AsyncStart())
+	require.NoError(t, underTest.Wait(context.Background()))
+
+	assert.Equal(t, 0, ack.acked)
+	assert.Equal(t, []error{writeErr}, ack.nacked)
+}
+
+func TestNewMeasurementPoint_AddsUnitAndDeviceTags(t *testing.T) {
+	m := Measurement{Id: "device", Value: 1, Unit: "°C", Tags: map[string]string{"site": "krk", deviceIDTag: "spoofed"}}
+
+	point := newMeasurementPoint(m, time.Now())
+
+	tags := make(map[string]string)
+	for _, tag := range point.TagList() {
+		tags[tag.Key] = tag.Value
+	}
+	assert.Equal(t, map[string]string{deviceIDTag: "device", unitTag: "°C", "site": "krk"}, tags)
+}
+
+type recordingAcknowledger struct {
+	acked  int
+	nacked []error
+}
+
+func (a *recordingAcknowledger) Ack() error {
+	a.acked++
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(reason error) error {
+	a.nacked = append(a.nacked, reason)
+	return nil
+}
+
+type recordingWriteAPI struct {
+	mu      sync.Mutex
+	batches [][]*write.Point
+	err     error
+}
+
+func (w *recordingWriteAPI) WriteRecord(_ context.Context, _ ...string) error {
+	return nil
+}
+
+func (w *recordingWriteAPI) WritePoint(_ context.Context, points ...*write.Point) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	w.batches = append(w.batches, points)
+	return nil
+}
+
+func (w *recordingWriteAPI) written() []*write.Point {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var points []*write.Point
+	for _, batch := range w.batches {
+		points = append(points, batch...)
+	}
+	return points
+}
+
+func (w *recordingWriteAPI) batchSizes() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sizes := make([]int, 0, len(w.batches))
+	for _, batch := range w.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsm",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tsm",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	measurementsPublishedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsm",
+		Name:      "measurements_published_total",
+		Help:      "Measurements published by device tickers.",
+	})
+
+	measurementPublishErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsm",
+		Name:      "measurement_publish_errors_total",
+		Help:      "Measurements device tickers failed to publish.",
+	})
+
+	activeDeviceTickers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tsm",
+		Name:      "active_device_tickers",
+		Help:      "Devices with a running ticker.",
+	})
+
+	measurementsConsumedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsm",
+		Name:      "measurements_consumed_total",
+		Help:      "Measurement messages consumed from RabbitMQ.",
+	})
+
+	measurementParseFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsm",
+		Name:      "measurement_parse_failures_total",
+		Help:      "Consumed measurement messages that could not be decoded.",
+	})
+
+	influxWriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "tsm",
+		Name:      "influx_write_duration_seconds",
+		Help:      "Latency of InfluxDB batch writes.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	influxPointsWrittenTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsm",
+		Name:      "influx_points_written_total",
+		Help:      "Measurements written to InfluxDB.",
+	})
+
+	influxWriteFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsm",
+		Name:      "influx_write_failures_total",
+		Help:      "InfluxDB batch writes that failed.",
+	})
+
+	measurementsWriterErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsm",
+		Name:      "measurements_writer_errors_total",
+		Help:      "Write and acknowledge errors reported by the measurements writer.",
+	})
+)
+
+// reportMeasurementsWriterError is the error handler of MeasurementsWriter.
+// Failed writes are nacked by the writer itself, so errors are only counted.
+func reportMeasurementsWriterError(err error) {
+	measurementsWriterErrorsTotal.Inc()
+	log.Print(err)
+}
+
+// metricsMiddleware counts requests by route template, so requests for
+// different devices are reported under the same /devices/{id} route.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush lets handlers behind metricsMiddleware stream their responses.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		r.wroteHeader = true
+		flusher.Flush()
+	}
+}
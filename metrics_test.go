@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsMiddlewareCountsRequestsByRouteTemplate(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.HandleFunc("/metrics-test/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}).Methods(http.MethodGet)
+
+	counter := httpRequestsTotal.WithLabelValues("/metrics-test/{id}", http.MethodGet, "404")
+	before := testutil.ToFloat64(counter)
+
+	for _, id := range []string{"a", "b"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics-test/"+id, nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	}
+
+	assert.Equal(t, before+2, testutil.ToFloat64(counter))
+}
+
+func TestMetricsMiddlewareDefaultsToOKStatus(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.HandleFunc("/metrics-test", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}).Methods(http.MethodGet)
+
+	counter := httpRequestsTotal.WithLabelValues("/metrics-test", http.MethodGet, "200")
+	before := testutil.ToFloat64(counter)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics-test", nil))
+
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
+
+func TestReportMeasurementsWriterErrorCountsErrors(t *testing.T) {
+	before := testutil.ToFloat64(measurementsWriterErrorsTotal)
+
+	reportMeasurementsWriterError(errors.New("mock error - failed to write measurements"))
+
+	assert.Equal(t, before+1, testutil.ToFloat64(measurementsWriterErrorsTotal))
+}
+
+func TestMetricsMiddlewareKeepsResponsesFlushable(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.HandleFunc("/metrics-test", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		require.True(t, ok)
+		_, _ = w.Write([]byte("streamed"))
+		flusher.Flush()
+	}).Methods(http.MethodGet)
+	res := httptest.NewRecorder()
+
+	router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics-test", nil))
+
+	assert.True(t, res.Flushed)
+}
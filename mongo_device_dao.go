@@ -3,21 +3,52 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	duplicateKeyErrCode  = 11000
+	indexNotFoundErrCode = 27
+
+	nameIndex       = "name_unique"
+	tenantNameIndex = "tenant_name_unique"
 )
 
 type mongoDeviceDAO struct {
 	db *mongo.Database
+	// uniqueNamePerTenant makes names unique among devices with the same
+	// tenant tag instead of among all devices.
+	uniqueNamePerTenant bool
+
+	// namesNotUnique explains why the unique name index is missing, nil
+	// once it exists.
+	mu             sync.Mutex
+	namesNotUnique error
 }
 
 func (dao *mongoDeviceDAO) Save(ctx context.Context, device Device) (Device, error) {
 	devices := dao.db.Collection("devices")
+	now := auditTime(time.Now())
 	device.ID = primitive.NewObjectID()
+	device.CreatedAt = &now
+	device.UpdatedAt = &now
+	device.Version = 1
 	insertResult, err := devices.InsertOne(ctx, device)
 	if err != nil {
+		if isDuplicateKeyErr(err) {
+			return device, deviceNameConflict(device)
+		}
+
 		return device, err
 	}
 
@@ -33,7 +64,7 @@ func (dao *mongoDeviceDAO) GetByID(ctx context.Context, id string) (*Device, err
 	var result Device
 	devices := dao.db.Collection("devices")
 
-	searchId, err := primitive.ObjectIDFromHex(id)
+	searchId, err := parseObjectID(id)
 	if err != nil {
 		return nil, err
 	}
@@ -49,17 +80,24 @@ func (dao *mongoDeviceDAO) GetByID(ctx context.Context, id string) (*Device, err
 	return &result, nil
 }
 
-func (dao *mongoDeviceDAO) GetAll(ctx context.Context, limit int, page int) ([]Device, error) {
-	if limit < 0 {
+func (dao *mongoDeviceDAO) GetAll(ctx context.Context, query DeviceQuery) ([]Device, error) {
+	if query.Limit < 0 {
 		return nil, errors.New("limit can't be negative")
 	}
 
-	var filter bson.M
+	sort, err := deviceSort(query)
+	if err != nil {
+		return nil, err
+	}
 
-	opts := &options.FindOptions{}
-	if limit > 0 {
-		opts.SetSkip(int64(limit * page)).
-			SetLimit(int64(limit))
+	opts := options.Find().SetSort(sort)
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+
+	filter, err := deviceFilter(query)
+	if err != nil {
+		return nil, err
 	}
 
 	devices := dao.db.Collection("devices")
@@ -80,3 +118,423 @@ func (dao *mongoDeviceDAO) GetAll(ctx context.Context, limit int, page int) ([]D
 
 	return result, nil
 }
+
+func (dao *mongoDeviceDAO) Update(ctx context.Context, id string, device Device, ifVersion int64) (*Device, error) {
+	var result Device
+	devices := dao.db.Collection("devices")
+
+	searchId, err := parseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	device.ID = searchId
+	device.CreatedAt = nil
+	device.UpdatedAt = nil
+	device.Version = 0
+
+	filter := bson.M{"_id": searchId}
+	if ifVersion > 0 {
+		filter["version"] = ifVersion
+	}
+
+	// The pipeline replaces the document while keeping createdAt, taken from
+	// the id for devices created before it was stored, and bumping version
+	// in the same atomic write. $literal keeps names starting with $ intact.
+	update := bson.A{bson.M{"$replaceWith": bson.M{"$mergeObjects": bson.A{
+		bson.M{"$literal": device},
+		bson.M{
+			"createdAt": bson.M{"$ifNull": bson.A{"$createdAt", bson.M{"$toDate": "$_id"}}},
+			"updatedAt": auditTime(time.Now()),
+			"version":   bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}},
+		},
+	}}}}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := devices.FindOneAndUpdate(ctx, filter, update, opts).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, dao.versionMismatch(ctx, searchId, ifVersion)
+		}
+
+		if isDuplicateKeyErr(err) {
+			return nil, deviceNameConflict(device)
+		}
+
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (dao *mongoDeviceDAO) Delete(ctx context.Context, id string, ifVersion int64) (bool, error) {
+	devices := dao.db.Collection("devices")
+
+	searchId, err := parseObjectID(id)
+	if err != nil {
+		return false, err
+	}
+
+	filter := bson.M{"_id": searchId}
+	if ifVersion > 0 {
+		filter["version"] = ifVersion
+	}
+
+	deleteResult, err := devices.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+
+	if deleteResult.DeletedCount == 0 {
+		return false, dao.versionMismatch(ctx, searchId, ifVersion)
+	}
+
+	return true, nil
+}
+
+// versionMismatch explains why a write found no device. An unconditional write
+// only misses a device that doesn't exist and gets nil, reported as not found.
+// A conditional write gets a VersionMismatchError even when the device is
+// gone, as a precondition on a missing resource fails too.
+func (dao *mongoDeviceDAO) versionMismatch(ctx context.Context, id primitive.ObjectID, ifVersion int64) error {
+	if ifVersion == 0 {
+		return nil
+	}
+
+	var current Device
+	opts := options.FindOne().SetProjection(bson.M{"version": 1})
+	if err := dao.db.Collection("devices").FindOne(ctx, bson.M{"_id": id}, opts).Decode(&current); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+
+	return &VersionMismatchError{Resource: "device", ID: id.Hex(), Expected: ifVersion, Actual: current.Version}
+}
+
+func (dao *mongoDeviceDAO) Count(ctx context.Context, query DeviceQuery) (int64, error) {
+	query.after = nil
+	filter, err := deviceFilter(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return dao.db.Collection("devices").CountDocuments(ctx, filter)
+}
+
+func deviceFilter(query DeviceQuery) (bson.M, error) {
+	filter := bson.M{}
+
+	var and bson.A
+	if query.Name != "" {
+		and = append(and, bson.M{"name": primitive.Regex{Pattern: regexp.QuoteMeta(query.Name), Options: "i"}})
+	}
+	if query.NameRegex != "" {
+		and = append(and, bson.M{"name": primitive.Regex{Pattern: query.NameRegex}})
+	}
+	if query.after != nil {
+		after, err := deviceAfterFilter(query)
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, after)
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+
+	interval := bson.M{}
+	if query.MinInterval > 0 {
+		interval["$gte"] = int64(query.MinInterval)
+	}
+	if query.MaxInterval > 0 {
+		interval["$lte"] = int64(query.MaxInterval)
+	}
+	if len(interval) > 0 {
+		filter["interval"] = interval
+	}
+
+	value := bson.M{}
+	if query.MinValue != nil {
+		value["$gte"] = *query.MinValue
+	}
+	if query.MaxValue != nil {
+		value["$lte"] = *query.MaxValue
+	}
+	if len(value) > 0 {
+		filter["value"] = value
+	}
+
+	if query.Unit != "" {
+		filter["unit"] = query.Unit
+	}
+
+	for key, tag := range query.Tags {
+		filter["tags."+key] = tag
+	}
+
+	return filter, nil
+}
+
+// deviceAfterFilter matches devices that come after the cursor in the order
+// of deviceSort.
+func deviceAfterFilter(query DeviceQuery) (bson.M, error) {
+	field, descending, err := query.sortField()
+	if err != nil {
+		return nil, err
+	}
+
+	after := query.after
+	op := "$gt"
+	if descending {
+		op = "$lt"
+	}
+
+	var value interface{}
+	switch field {
+	case sortByName:
+		value = after.Name
+	case sortByInterval:
+		value = after.Interval
+	case sortByValue:
+		value = after.Value
+	default:
+		return bson.M{"_id": bson.M{op: after.ID}}, nil
+	}
+
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{op: value}},
+		bson.M{field: value, "_id": bson.M{"$gt": after.ID}},
+	}}, nil
+}
+
+// deviceSort orders by the requested field and then by _id, so devices with
+// equal values keep the same order between pages. The _id also carries the
+// creation time, which makes it the createdAt sort key.
+func deviceSort(query DeviceQuery) (bson.D, error) {
+	field, descending, err := query.sortField()
+	if err != nil {
+		return nil, err
+	}
+
+	direction := 1
+	if descending {
+		direction = -1
+	}
+
+	if field == sortByCreatedAt {
+		return bson.D{{Key: "_id", Value: direction}}, nil
+	}
+
+	return bson.D{{Key: field, Value: direction}, {Key: "_id", Value: 1}}, nil
+}
+
+// EnsureIndexes creates the unique name index and the indexes used by device
+// filters and sorting. The unique name index of the other scope is dropped
+// once the new one exists, so switching between global and per tenant names
+// only needs a restart and names stay unique meanwhile. While stored names
+// aren't unique, the unique index is left out and Ready reports the
+// duplicates until they are renamed.
+func (dao *mongoDeviceDAO) EnsureIndexes(ctx context.Context) error {
+	indexes := dao.db.Collection("devices").Indexes()
+
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetName("name_id")},
+		{Keys: bson.D{{Key: "interval", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetName("interval_id")},
+		{Keys: bson.D{{Key: "value", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetName("value_id")},
+		{Keys: bson.D{{Key: "unit", Value: 1}}, Options: options.Index().SetName("unit")},
+		{Keys: bson.D{{Key: "tags.$**", Value: 1}}, Options: options.Index().SetName("tags")},
+	}
+
+	if _, err := indexes.CreateMany(ctx, models); err != nil {
+		return fmt.Errorf("failed to create device indexes: %w", err)
+	}
+
+	if err := dao.ensureUniqueNameIndex(ctx); err != nil {
+		return err
+	}
+
+	if err := dao.uniqueNamesErr(); err != nil {
+		log.Print(err)
+	}
+
+	return nil
+}
+
+// Ready fails while device names aren't enforced unique. It tries to create
+// the unique name index again, so renaming the duplicates is enough to make
+// the service ready.
+func (dao *mongoDeviceDAO) Ready(ctx context.Context) error {
+	if dao.uniqueNamesErr() == nil {
+		return nil
+	}
+
+	if err := dao.ensureUniqueNameIndex(ctx); err != nil {
+		return err
+	}
+
+	return dao.uniqueNamesErr()
+}
+
+func (dao *mongoDeviceDAO) uniqueNamesErr() error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+
+	return dao.namesNotUnique
+}
+
+func (dao *mongoDeviceDAO) setUniqueNamesErr(err error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+
+	dao.namesNotUnique = err
+}
+
+// ensureUniqueNameIndex creates the unique name index of the configured scope
+// and drops the one of the other scope. Duplicate names don't fail it, they
+// are kept for Ready instead.
+func (dao *mongoDeviceDAO) ensureUniqueNameIndex(ctx context.Context) error {
+	indexes := dao.db.Collection("devices").Indexes()
+
+	unique := mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetName(nameIndex).SetUnique(true),
+	}
+	stale := tenantNameIndex
+	if dao.uniqueNamePerTenant {
+		unique = mongo.IndexModel{
+			Keys:    bson.D{{Key: "tags." + tenantTag, Value: 1}, {Key: "name", Value: 1}},
+			Options: options.Index().SetName(tenantNameIndex).SetUnique(true),
+		}
+		stale = nameIndex
+	}
+
+	duplicates, err := dao.duplicateNames(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look for duplicate device names: %w", err)
+	}
+	if len(duplicates) > 0 {
+		dao.setUniqueNamesErr(fmt.Errorf("device names are not unique, index %v is not created until these devices are renamed: %v", *unique.Options.Name, strings.Join(duplicates, ", ")))
+		return nil
+	}
+
+	if _, err := indexes.CreateOne(ctx, unique); err != nil {
+		if isDuplicateKeyErr(err) {
+			dao.setUniqueNamesErr(fmt.Errorf("device names are not unique, index %v is not created: %w", *unique.Options.Name, err))
+			return nil
+		}
+		return fmt.Errorf("failed to create index %v: %w", *unique.Options.Name, err)
+	}
+
+	if _, err := indexes.DropOne(ctx, stale); err != nil && !isCommandErr(err, indexNotFoundErrCode) {
+		return fmt.Errorf("failed to drop index %v: %w", stale, err)
+	}
+
+	dao.setUniqueNamesErr(nil)
+	return nil
+}
+
+// maxReportedDuplicateNames bounds the duplicates logged by EnsureIndexes.
+const maxReportedDuplicateNames = 20
+
+// duplicateNames returns names shared by devices, prefixed with the tenant
+// when names are unique per tenant, with the number of devices using them.
+func (dao *mongoDeviceDAO) duplicateNames(ctx context.Context) ([]string, error) {
+	cursor, err := dao.db.Collection("devices").Aggregate(ctx, duplicateNamesPipeline(dao.uniqueNamePerTenant))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Key struct {
+			Tenant string `bson:"tenant"`
+			Name   string `bson:"name"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	duplicates := make([]string, 0, len(groups))
+	for _, group := range groups {
+		name := strconv.Quote(group.Key.Name)
+		if dao.uniqueNamePerTenant {
+			name = strconv.Quote(group.Key.Tenant) + "/" + name
+		}
+		duplicates = append(duplicates, fmt.Sprintf("%v (%d devices)", name, group.Count))
+	}
+
+	return duplicates, nil
+}
+
+func duplicateNamesPipeline(perTenant bool) mongo.Pipeline {
+	key := bson.M{"name": "$name"}
+	if perTenant {
+		key["tenant"] = "$tags." + tenantTag
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": key, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: maxReportedDuplicateNames}},
+	}
+}
+
+func isDuplicateKeyErr(err error) bool {
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if e.Code == duplicateKeyErrCode {
+				return true
+			}
+		}
+	}
+
+	return isCommandErr(err, duplicateKeyErrCode)
+}
+
+func isCommandErr(err error, code int32) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && commandErr.Code == code
+}
+
+// MigrateAuditFields stamps devices created before createdAt, updatedAt and
+// version were stored. The creation time is taken from the id.
+func (dao *mongoDeviceDAO) MigrateAuditFields(ctx context.Context) (int64, error) {
+	devices := dao.db.Collection("devices")
+
+	filter := bson.M{"createdAt": bson.M{"$exists": false}}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"createdAt": bson.M{"$toDate": "$_id"},
+			"updatedAt": bson.M{"$toDate": "$_id"},
+			"version":   bson.M{"$ifNull": bson.A{"$version", 1}},
+		}},
+	}
+
+	result, err := devices.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
+
+// MigrateIntervals converts intervals stored as seconds, before sub-second
+// intervals were supported, to the current nanoseconds representation.
+func (dao *mongoDeviceDAO) MigrateIntervals(ctx context.Context) (int64, error) {
+	devices := dao.db.Collection("devices")
+
+	filter := bson.M{"interval": bson.M{"$type": bson.A{"int", "double"}}}
+	update := bson.A{
+		bson.M{"$set": bson.M{"interval": bson.M{"$toLong": bson.M{"$multiply": bson.A{"$interval", int64(time.Second)}}}}},
+	}
+
+	result, err := devices.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"testing"
+)
+
+func TestIsDuplicateKeyErr(t *testing.T) {
+	testCases := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"insert":          {err: mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: duplicateKeyErrCode}}}, expected: true},
+		"find and modify": {err: mongo.CommandError{Code: duplicateKeyErrCode}, expected: true},
+		"wrapped":         {err: fmt.Errorf("save: %w", mongo.CommandError{Code: duplicateKeyErrCode}), expected: true},
+		"other write":     {err: mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121}}}, expected: false},
+		"other":           {err: errors.New("connection refused"), expected: false},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, isDuplicateKeyErr(testCase.err))
+		})
+	}
+}
+
+func TestDuplicateNamesPipelineGroupsByScope(t *testing.T) {
+	global := duplicateNamesPipeline(false)
+	perTenant := duplicateNamesPipeline(true)
+
+	assert.Equal(t, bson.M{"name": "$name"}, global[0][0].Value.(bson.M)["_id"])
+	assert.Equal(t, bson.M{"name": "$name", "tenant": "$tags." + tenantTag}, perTenant[0][0].Value.(bson.M)["_id"])
+	assert.Equal(t, bson.M{"count": bson.M{"$gt": 1}}, global[1][0].Value)
+}
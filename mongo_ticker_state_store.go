@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const tickerStateID = "ticker"
+
+type mongoTickerStateStore struct {
+	db *mongo.Database
+}
+
+func (store *mongoTickerStateStore) Load(ctx context.Context) (tickerState, error) {
+	var state tickerState
+	states := store.db.Collection("tickerState")
+
+	if err := states.FindOne(ctx, bson.M{"_id": tickerStateID}).Decode(&state); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return tickerState{}, nil
+		}
+
+		return tickerState{}, err
+	}
+
+	return state, nil
+}
+
+func (store *mongoTickerStateStore) Save(ctx context.Context, state tickerState) error {
+	states := store.db.Collection("tickerState")
+
+	_, err := states.ReplaceOne(ctx, bson.M{"_id": tickerStateID}, state, options.Replace().SetUpsert(true))
+
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details body. Every handler reports errors
+// with it so clients can rely on a single error format.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func newProblem(r *http.Request, status int, detail string) Problem {
+	return Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblemBody(w, status, newProblem(r, status, detail))
+}
+
+// writeProblemBody writes a problem that carries extension members, body has
+// to embed the Problem.
+func writeProblemBody(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Print(err)
+	}
+}
+
+// notFound and methodNotAllowed answer requests the router has no route for,
+// so those errors are problems too.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, "no resource at "+r.URL.Path)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusMethodNotAllowed, r.Method+" is not allowed for "+r.URL.Path)
+}
+
+// writeError maps err to a response status. Errors that don't match any of the
+// sentinel errors are programming errors, so their details are not exposed.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, detail := errorStatus(err)
+	writeProblem(w, r, status, detail)
+}
+
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrValidation):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed, err.Error()
+	case errors.Is(err, ErrStorage):
+		return http.StatusInternalServerError, err.Error()
+	default:
+		return http.StatusInternalServerError, ""
+	}
+}
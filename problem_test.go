@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteErrorMapsSentinelErrorsToStatus(t *testing.T) {
+	testCases := map[error]int{
+		&ValidationError{Field: "name", Reason: "invalid"}:                         http.StatusBadRequest,
+		&NotFoundError{Resource: "device", ID: "1"}:                                http.StatusNotFound,
+		fmt.Errorf("duplicate name: %w", ErrConflict):                              http.StatusConflict,
+		&VersionMismatchError{Resource: "device", ID: "1", Expected: 1, Actual: 2}: http.StatusPreconditionFailed,
+		&StorageError{Op: "failed", Err: errors.New("db is down")}:                 http.StatusInternalServerError,
+	}
+
+	for err, status := range testCases {
+		t.Run(err.Error(), func(t *testing.T) {
+			res := httptest.NewRecorder()
+
+			writeError(res, httptest.NewRequest(http.MethodGet, "/devices", nil), err)
+
+			assert.Equal(t, status, res.Code)
+			assert.Equal(t, problemContentType, res.Header().Get("Content-Type"))
+			assert.Contains(t, res.Body.String(), fmt.Sprintf(`"detail":%q`, err.Error()))
+		})
+	}
+}
+
+func TestWriteErrorHidesUnexpectedErrors(t *testing.T) {
+	res := httptest.NewRecorder()
+
+	writeError(res, httptest.NewRequest(http.MethodGet, "/devices", nil), errors.New("secret connection string"))
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	require.JSONEq(t, `{
+		"type":"about:blank",
+		"title":"Internal Server Error",
+		"status":500,
+		"instance":"/devices"
+	}`, res.Body.String())
+}
+
+func TestRouterReportsUnknownRoutesAsProblems(t *testing.T) {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+
+	notFoundRes := httptest.NewRecorder()
+	router.ServeHTTP(notFoundRes, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	methodRes := httptest.NewRecorder()
+	router.ServeHTTP(methodRes, httptest.NewRequest(http.MethodDelete, "/devices", nil))
+
+	assert.Equal(t, http.StatusNotFound, notFoundRes.Code)
+	assert.Equal(t, problemContentType, notFoundRes.Header().Get("Content-Type"))
+	require.JSONEq(t, `{
+		"type":"about:blank",
+		"title":"Not Found",
+		"status":404,
+		"detail":"no resource at /unknown",
+		"instance":"/unknown"
+	}`, notFoundRes.Body.String())
+	assert.Equal(t, http.StatusMethodNotAllowed, methodRes.Code)
+	assert.Equal(t, problemContentType, methodRes.Header().Get("Content-Type"))
+	require.JSONEq(t, `{
+		"type":"about:blank",
+		"title":"Method Not Allowed",
+		"status":405,
+		"detail":"DELETE is not allowed for /devices",
+		"instance":"/devices"
+	}`, methodRes.Body.String())
+}
@@ -1,28 +1,145 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"github.com/streadway/amqp"
 	"log"
-	"strconv"
+	"sync"
+	"time"
 )
 
+const (
+	measurementsConsumerTag = "tsm-measurements-writer"
+	measurementsPrefetch    = 500
+	retryCountHeader        = "x-tsm-retry-count"
+	maxWriteRetries         = 5
+	reconnectMinBackoff     = 500 * time.Millisecond
+	reconnectMaxBackoff     = 30 * time.Second
+	publishConfirmTimeout   = 10 * time.Second
+
+	deadLetterExchange    = "measurements.dead-letter"
+	deadLetterQueue       = "measurements.dead-letter"
+	failureReasonHeader   = "x-tsm-failure-reason"
+	failureCategoryHeader = "x-tsm-failure-category"
+
+	failureMalformedPayload = "malformed-payload"
+	failureRetriesExhausted = "retries-exhausted"
+)
+
+var (
+	errRabbitMQNotConnected = errors.New("not connected to RabbitMQ")
+	errPublishNotConfirmed  = errors.New("RabbitMQ didn't confirm the publish")
+)
+
+// rabbitMQConnection and rabbitMQChannel are the parts of amqp.Connection and
+// amqp.Channel used by the exchanger, so reconnecting can be tested without a
+// broker.
+type rabbitMQConnection interface {
+	Channel() (rabbitMQChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+type rabbitMQChannel interface {
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	Cancel(consumer string, noWait bool) error
+	Close() error
+}
+
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (rabbitMQChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// rabbitMQMeasurementExchanger publishes and consumes measurements. A
+// supervisor goroutine watches the connection and, when it is lost, reconnects
+// with exponential backoff and declares the topology again. The receiver
+// created by CreateReceiver resumes consuming once the connection is back.
 type rabbitMQMeasurementExchanger struct {
-	measurements *amqp.Channel
+	url string
+	// dial opens a connection with the measurements topology declared and
+	// after waits between reconnect attempts.
+	dial  func() (rabbitMQConnection, rabbitMQChannel, error)
+	after func(d time.Duration) <-chan time.Time
+
+	mu            sync.RWMutex
+	conn          rabbitMQConnection
+	measurements  rabbitMQChannel
+	reconnected   chan struct{}
+	stopConsuming bool
+	closed        chan struct{}
+
+	// confirmMu serializes publishes on the confirmed channel, so every
+	// confirmation belongs to the publish waiting for it.
+	confirmMu   sync.Mutex
+	confirmConn rabbitMQConnection
+	confirmed   rabbitMQChannel
+	confirms    chan amqp.Confirmation
 }
 
 func newRabbitMQMeasurementExchanger(url string) (*rabbitMQMeasurementExchanger, error) {
-	conn, err := amqp.Dial(url)
-	if err != nil {
+	rme := &rabbitMQMeasurementExchanger{url: url, after: time.After, closed: make(chan struct{})}
+	rme.dial = rme.dialURL
+
+	if err := rme.connect(); err != nil {
 		return nil, err
 	}
 
+	return rme, nil
+}
+
+// connect opens the first connection and starts supervising it.
+func (rme *rabbitMQMeasurementExchanger) connect() error {
+	conn, measurements, err := rme.dial()
+	if err != nil {
+		return err
+	}
+
+	rme.conn = conn
+	rme.measurements = measurements
+	go rme.supervise(conn, measurements)
+
+	return nil
+}
+
+func (rme *rabbitMQMeasurementExchanger) dialURL() (rabbitMQConnection, rabbitMQChannel, error) {
+	conn, err := amqp.Dial(rme.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	measurements, err := conn.Channel()
+	if err == nil {
+		err = declareMeasurementsTopology(measurements)
+	}
+	if err == nil {
+		err = measurements.Qos(measurementsPrefetch, 0, false)
+	}
 	if err != nil {
-		return nil, err
+		_ = conn.Close()
+		return nil, nil, err
 	}
 
-	err = measurements.ExchangeDeclare(
+	return amqpConnection{conn}, measurements, nil
+}
+
+func declareMeasurementsTopology(measurements *amqp.Channel) error {
+	err := measurements.ExchangeDeclare(
 		"measurements",
 		"topic",
 		true,
@@ -31,19 +148,19 @@ func newRabbitMQMeasurementExchanger(url string) (*rabbitMQMeasurementExchanger,
 		false,
 		nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	_, err = measurements.QueueDeclare(
 		"measurements",
+		true,
 		false,
 		false,
-		true,
 		false,
 		nil,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	err = measurements.QueueBind(
@@ -53,45 +170,543 @@ func newRabbitMQMeasurementExchanger(url string) (*rabbitMQMeasurementExchanger,
 		false,
 		nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	err = measurements.ExchangeDeclare(
+		deadLetterExchange,
+		"fanout",
+		true,
+		false,
+		false,
+		false,
+		nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = measurements.QueueDeclare(
+		deadLetterQueue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	return measurements.QueueBind(
+		deadLetterQueue,
+		"",
+		deadLetterExchange,
+		false,
+		nil)
+}
+
+func (rme *rabbitMQMeasurementExchanger) supervise(conn rabbitMQConnection, measurements rabbitMQChannel) {
+	for {
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := measurements.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case err := <-connClosed:
+			log.Printf("RabbitMQ connection closed: %v", err)
+		case err := <-channelClosed:
+			log.Printf("RabbitMQ channel closed: %v", err)
+			_ = conn.Close()
+		}
+
+		select {
+		case <-rme.closed:
+			return
+		default:
+		}
+
+		rme.mu.Lock()
+		rme.conn = nil
+		rme.measurements = nil
+		rme.reconnected = make(chan struct{})
+		rme.mu.Unlock()
+
+		var ok bool
+		if conn, measurements, ok = rme.reconnect(); !ok {
+			return
+		}
+	}
+}
+
+func (rme *rabbitMQMeasurementExchanger) reconnect() (rabbitMQConnection, rabbitMQChannel, bool) {
+	backoff := reconnectMinBackoff
+
+	for {
+		select {
+		case <-rme.closed:
+			return nil, nil, false
+		case <-rme.after(backoff):
+		}
+
+		conn, measurements, err := rme.dial()
+		if err != nil {
+			if backoff *= 2; backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+			log.Printf("reconnecting to RabbitMQ failed, next attempt in %v: %v", backoff, err)
+			continue
+		}
+
+		rme.mu.Lock()
+		select {
+		case <-rme.closed:
+			rme.mu.Unlock()
+			_ = conn.Close()
+			return nil, nil, false
+		default:
+		}
+		rme.conn = conn
+		rme.measurements = measurements
+		close(rme.reconnected)
+		rme.reconnected = nil
+		rme.mu.Unlock()
+
+		log.Print("reconnected to RabbitMQ")
+		return conn, measurements, true
+	}
+}
+
+// current returns the channel of the live connection. While reconnecting it
+// returns nil and a channel that is closed once the connection is back.
+func (rme *rabbitMQMeasurementExchanger) current() (rabbitMQChannel, <-chan struct{}) {
+	rme.mu.RLock()
+	defer rme.mu.RUnlock()
+
+	return rme.measurements, rme.reconnected
+}
+
+func (rme *rabbitMQMeasurementExchanger) connection() (rabbitMQConnection, error) {
+	rme.mu.RLock()
+	defer rme.mu.RUnlock()
+
+	if rme.conn == nil {
+		return nil, errRabbitMQNotConnected
 	}
 
-	return &rabbitMQMeasurementExchanger{measurements: measurements}, nil
+	return rme.conn, nil
 }
 
-func (rme *rabbitMQMeasurementExchanger) Publish(id string, value float64) error {
-	return rme.measurements.Publish("measurements", id, false, false,
-		amqp.Publishing{ContentType: "text/plain", Body: []byte(fmt.Sprintf("%f", value))})
+// Ready tells whether the connection and its measurements channel are open.
+func (rme *rabbitMQMeasurementExchanger) Ready(ctx context.Context) error {
+	conn, err := rme.connection()
+	if err != nil {
+		return err
+	}
+
+	if measurements, _ := rme.current(); measurements == nil || conn.IsClosed() {
+		return errRabbitMQNotConnected
+	}
+
+	return nil
+}
+
+func (rme *rabbitMQMeasurementExchanger) Publish(m Measurement) error {
+	measurements, _ := rme.current()
+	if measurements == nil {
+		return errRabbitMQNotConnected
+	}
+
+	body, err := encodeMeasurement(m)
+	if err != nil {
+		return err
+	}
+
+	return measurements.Publish("measurements", m.Id, false, false,
+		amqp.Publishing{
+			ContentType:  contentTypeJSON,
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    m.Time,
+			Body:         body,
+		})
 }
 
 func (rme *rabbitMQMeasurementExchanger) CreateReceiver() (<-chan Measurement, error) {
-	delivery, err := rme.measurements.Consume(
+	measurements, _ := rme.current()
+	if measurements == nil {
+		return nil, errRabbitMQNotConnected
+	}
+
+	delivery, err := consumeMeasurements(measurements)
+	if err != nil {
+		return nil, err
+	}
+
+	received := make(chan Measurement, 10)
+
+	go func() {
+		defer close(received)
+
+		for delivery != nil {
+			for d := range delivery {
+				rme.receive(d, received)
+			}
+
+			delivery = rme.resumeConsuming()
+		}
+	}()
+
+	return received, nil
+}
+
+func consumeMeasurements(measurements rabbitMQChannel) (<-chan amqp.Delivery, error) {
+	return measurements.Consume(
 		"measurements",
-		"",
-		true,
+		measurementsConsumerTag,
+		false,
 		false,
 		false,
 		false,
 		nil,
 	)
+}
 
-	if err != nil {
-		return nil, err
+func (rme *rabbitMQMeasurementExchanger) receive(d amqp.Delivery, received chan<- Measurement) {
+	measurementsConsumedTotal.Inc()
+
+	m, decodeErr := decodeMeasurement(d.ContentType, d.RoutingKey, d.Body)
+	if decodeErr != nil {
+		log.Print(decodeErr)
+		measurementParseFailuresTotal.Inc()
+		if err := rme.deadLetter(d, failureMalformedPayload, decodeErr); err != nil {
+			log.Print(err)
+		}
+		return
 	}
 
-	measurements := make(chan Measurement, 10)
+	m.ack = &rabbitMQDelivery{rme: rme, delivery: d}
+	received <- m
+}
 
-	go func() {
-		for d := range delivery {
-			value, parseValErr := strconv.ParseFloat(string(d.Body), 64)
-			if parseValErr != nil {
-				log.Print(parseValErr)
+// resumeConsuming waits for the connection to come back and consumes again.
+// It returns nil when consuming was stopped or the exchanger closed.
+func (rme *rabbitMQMeasurementExchanger) resumeConsuming() <-chan amqp.Delivery {
+	for {
+		rme.mu.RLock()
+		stopConsuming := rme.stopConsuming
+		rme.mu.RUnlock()
+		if stopConsuming {
+			return nil
+		}
+
+		measurements, reconnected := rme.current()
+		if measurements == nil {
+			select {
+			case <-reconnected:
 				continue
+			case <-rme.closed:
+				return nil
 			}
+		}
 
-			measurements <- Measurement{Id: d.RoutingKey, Value: value}
+		delivery, err := consumeMeasurements(measurements)
+		if err == nil {
+			return delivery
 		}
-	}()
 
-	return measurements, nil
+		log.Printf("resuming measurements consumption failed: %v", err)
+		select {
+		case <-time.After(reconnectMinBackoff):
+		case <-rme.closed:
+			return nil
+		}
+	}
+}
+
+// StopConsuming cancels the consumer created by CreateReceiver. Deliveries
+// already received from the broker are still passed on before the receiver
+// channel is closed.
+func (rme *rabbitMQMeasurementExchanger) StopConsuming() error {
+	rme.mu.Lock()
+	rme.stopConsuming = true
+	measurements := rme.measurements
+	rme.mu.Unlock()
+
+	if measurements == nil {
+		return errRabbitMQNotConnected
+	}
+
+	return measurements.Cancel(measurementsConsumerTag, false)
+}
+
+func (rme *rabbitMQMeasurementExchanger) Close() error {
+	rme.mu.Lock()
+	defer rme.mu.Unlock()
+
+	close(rme.closed)
+
+	if rme.conn == nil {
+		return nil
+	}
+
+	if err := rme.measurements.Close(); err != nil {
+		return err
+	}
+
+	return rme.conn.Close()
+}
+
+// deadLetter moves the delivery to the dead-letter queue, recording why it
+// could not be stored. The delivery is acknowledged once the broker confirmed
+// the dead letter and requeued if the move fails.
+func (rme *rabbitMQMeasurementExchanger) deadLetter(d amqp.Delivery, category string, reason error) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[failureCategoryHeader] = category
+	headers[failureReasonHeader] = reason.Error()
+
+	err := rme.publishConfirmed(deadLetterExchange, d.RoutingKey,
+		amqp.Publishing{
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			Headers:      headers,
+			Body:         d.Body,
+		})
+	if err != nil {
+		if nackErr := d.Nack(false, true); nackErr != nil {
+			log.Print(nackErr)
+		}
+		return err
+	}
+
+	return d.Ack(false)
+}
+
+// DeadLetters returns up to limit dead-lettered measurements without removing
+// them from the queue. The messages are fetched on a dedicated channel and are
+// requeued by the broker when the channel is closed.
+func (rme *rabbitMQMeasurementExchanger) DeadLetters(limit int) ([]DeadLetter, error) {
+	conn, err := rme.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	deadLetters := make([]DeadLetter, 0)
+	for len(deadLetters) < limit {
+		d, ok, err := ch.Get(deadLetterQueue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		deadLetters = append(deadLetters, DeadLetter{
+			DeviceID:       d.RoutingKey,
+			ContentType:    d.ContentType,
+			Body:           string(d.Body),
+			Category:       headerString(d.Headers, failureCategoryHeader),
+			Reason:         headerString(d.Headers, failureReasonHeader),
+			Retries:        retryCount(d.Headers),
+			DeadLetteredAt: d.Timestamp,
+		})
+	}
+
+	return deadLetters, nil
+}
+
+// ReplayDeadLetters publishes up to limit dead-lettered measurements back to
+// the measurements exchange with their failure and retry headers cleared. A
+// dead letter is removed only after the broker confirmed its replay.
+func (rme *rabbitMQMeasurementExchanger) ReplayDeadLetters(limit int) (int, error) {
+	conn, err := rme.connection()
+	if err != nil {
+		return 0, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	replayed := 0
+	for replayed < limit {
+		d, ok, err := ch.Get(deadLetterQueue, false)
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			break
+		}
+
+		headers := amqp.Table{}
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		delete(headers, failureCategoryHeader)
+		delete(headers, failureReasonHeader)
+		delete(headers, retryCountHeader)
+
+		err = rme.publishConfirmed("measurements", d.RoutingKey,
+			amqp.Publishing{
+				ContentType:  d.ContentType,
+				DeliveryMode: amqp.Persistent,
+				Headers:      headers,
+				Body:         d.Body,
+			})
+		if err != nil {
+			return replayed, err
+		}
+
+		if err = d.Ack(false); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// publishConfirmed publishes on a channel in confirm mode and returns once the
+// broker has taken the message. A delivery is acknowledged only after its
+// copy is published this way, otherwise a lost publish would lose it.
+func (rme *rabbitMQMeasurementExchanger) publishConfirmed(exchange, key string, msg amqp.Publishing) error {
+	rme.confirmMu.Lock()
+	defer rme.confirmMu.Unlock()
+
+	conn, err := rme.connection()
+	if err != nil {
+		return err
+	}
+
+	if rme.confirmed == nil || rme.confirmConn != conn {
+		if err := rme.openConfirmed(conn); err != nil {
+			return err
+		}
+	}
+
+	if err := rme.confirmed.Publish(exchange, key, false, false, msg); err != nil {
+		rme.closeConfirmed()
+		return err
+	}
+
+	select {
+	case confirmation, ok := <-rme.confirms:
+		if !ok {
+			rme.closeConfirmed()
+			return errPublishNotConfirmed
+		}
+		if !confirmation.Ack {
+			return errPublishNotConfirmed
+		}
+		return nil
+	case <-rme.after(publishConfirmTimeout):
+		// a late confirmation would be taken for the next publish
+		rme.closeConfirmed()
+		return errPublishNotConfirmed
+	}
+}
+
+func (rme *rabbitMQMeasurementExchanger) openConfirmed(conn rabbitMQConnection) error {
+	rme.closeConfirmed()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return err
+	}
+
+	rme.confirmConn = conn
+	rme.confirmed = ch
+	rme.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	return nil
+}
+
+func (rme *rabbitMQMeasurementExchanger) closeConfirmed() {
+	if rme.confirmed != nil {
+		_ = rme.confirmed.Close()
+	}
+
+	rme.confirmConn = nil
+	rme.confirmed = nil
+	rme.confirms = nil
+}
+
+// rabbitMQDelivery acknowledges a single measurement delivery. A failed write
+// is retried by publishing the measurement again with an increased retry
+// count, so it goes to the back of the queue instead of being redelivered
+// immediately. The delivery is acknowledged once the broker confirmed the
+// copy, and requeued when it didn't. After maxWriteRetries the measurement is
+// dead-lettered.
+type rabbitMQDelivery struct {
+	rme      *rabbitMQMeasurementExchanger
+	delivery amqp.Delivery
+}
+
+func (d *rabbitMQDelivery) Ack() error {
+	return d.delivery.Ack(false)
+}
+
+func (d *rabbitMQDelivery) Nack(reason error) error {
+	retries := retryCount(d.delivery.Headers)
+	if retries >= maxWriteRetries {
+		log.Printf("dead-lettering measurement of device %v after %d retries: %v", d.delivery.RoutingKey, retries, reason)
+		return d.rme.deadLetter(d.delivery, failureRetriesExhausted, reason)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range d.delivery.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int32(retries + 1)
+
+	err := d.rme.publishConfirmed("measurements", d.delivery.RoutingKey,
+		amqp.Publishing{
+			ContentType:  d.delivery.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Headers:      headers,
+			Body:         d.delivery.Body,
+		})
+	if err != nil {
+		log.Print(err)
+		return d.delivery.Nack(false, true)
+	}
+
+	return d.delivery.Ack(false)
+}
+
+func retryCount(headers amqp.Table) int {
+	switch v := headers[retryCountHeader].(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+func headerString(headers amqp.Table, key string) string {
+	if v, ok := headers[key].(string); ok {
+		return v
+	}
+
+	return ""
 }
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRabbitMQMeasurementExchanger_ResumesConsumingAfterReconnect(t *testing.T) {
+	first := newFakeRabbitMQConnection()
+	second := newFakeRabbitMQConnection()
+	dialer := fakeRabbitMQDialer{results: []fakeDialResult{
+		{conn: first},
+		{err: errors.New("mock error - connection refused")},
+		{err: errors.New("mock error - connection refused")},
+		{conn: second},
+	}}
+	backoffs := make(chan time.Duration, 10)
+
+	underTest := &rabbitMQMeasurementExchanger{
+		dial: dialer.dial,
+		after: func(d time.Duration) <-chan time.Time {
+			backoffs <- d
+			return time.After(0)
+		},
+		closed: make(chan struct{}),
+	}
+	require.NoError(t, underTest.connect())
+	defer underTest.Close()
+
+	received, err := underTest.CreateReceiver()
+	require.NoError(t, err)
+
+	first.channel.deliver(t, Measurement{Id: "device", Value: 1})
+	assert.Equal(t, float64(1), (<-received).Value)
+
+	first.drop()
+	second.channel.deliver(t, Measurement{Id: "device", Value: 2})
+	assert.Equal(t, float64(2), (<-received).Value)
+
+	assert.Equal(t, []time.Duration{reconnectMinBackoff, 2 * reconnectMinBackoff, 4 * reconnectMinBackoff},
+		[]time.Duration{<-backoffs, <-backoffs, <-backoffs})
+	assert.NoError(t, underTest.Ready(context.Background()))
+}
+
+func TestRabbitMQDelivery_NackRepublishesWithRetryCountAndAcksAfterConfirm(t *testing.T) {
+	conn := newFakeRabbitMQConnection()
+	underTest, received := newConsumingFakeExchanger(t, conn)
+	defer underTest.Close()
+
+	tag := conn.channel.deliverWithHeaders(t, Measurement{Id: "device", Value: 1}, amqp.Table{retryCountHeader: int32(2)})
+	m := <-received
+
+	require.NoError(t, m.ack.Nack(errors.New("mock error - write failed")))
+
+	published := conn.broker.publishes()
+	require.Len(t, published, 1)
+	assert.Equal(t, "measurements", published[0].exchange)
+	assert.Equal(t, "device", published[0].key)
+	assert.Equal(t, int32(3), published[0].msg.Headers[retryCountHeader])
+	assert.Equal(t, contentTypeJSON, published[0].msg.ContentType)
+	acked, requeued := conn.broker.acknowledgements()
+	assert.Equal(t, []uint64{tag}, acked)
+	assert.Empty(t, requeued)
+}
+
+func TestRabbitMQDelivery_NackRequeuesWhenRepublishIsNotConfirmed(t *testing.T) {
+	conn := newFakeRabbitMQConnection()
+	conn.broker.refuseConfirms = true
+	underTest, received := newConsumingFakeExchanger(t, conn)
+	defer underTest.Close()
+
+	tag := conn.channel.deliver(t, Measurement{Id: "device", Value: 1})
+	m := <-received
+
+	assert.NoError(t, m.ack.Nack(errors.New("mock error - write failed")))
+
+	acked, requeued := conn.broker.acknowledgements()
+	assert.Empty(t, acked)
+	assert.Equal(t, []uint64{tag}, requeued)
+}
+
+func TestRabbitMQDelivery_NackDeadLettersAfterMaxWriteRetries(t *testing.T) {
+	conn := newFakeRabbitMQConnection()
+	underTest, received := newConsumingFakeExchanger(t, conn)
+	defer underTest.Close()
+
+	for _, retries := range []int32{maxWriteRetries - 1, maxWriteRetries} {
+		conn.channel.deliverWithHeaders(t, Measurement{Id: "device", Value: 1}, amqp.Table{retryCountHeader: retries})
+		m := <-received
+		require.NoError(t, m.ack.Nack(errors.New("mock error - write failed")))
+	}
+
+	published := conn.broker.publishes()
+	require.Len(t, published, 2)
+	assert.Equal(t, "measurements", published[0].exchange)
+	assert.Equal(t, int32(maxWriteRetries), published[0].msg.Headers[retryCountHeader])
+	assert.Equal(t, deadLetterExchange, published[1].exchange)
+	assert.Equal(t, failureRetriesExhausted, published[1].msg.Headers[failureCategoryHeader])
+	assert.Equal(t, "mock error - write failed", published[1].msg.Headers[failureReasonHeader])
+	acked, _ := conn.broker.acknowledgements()
+	assert.Len(t, acked, 2)
+}
+
+func TestRabbitMQMeasurementExchanger_DeadLettersMalformedPayload(t *testing.T) {
+	conn := newFakeRabbitMQConnection()
+	underTest, received := newConsumingFakeExchanger(t, conn)
+	defer underTest.Close()
+
+	tag := conn.channel.deliverRaw(amqp.Delivery{ContentType: contentTypeJSON, RoutingKey: "device", Body: []byte("not json")})
+	next := conn.channel.deliver(t, Measurement{Id: "device", Value: 2})
+	m := <-received
+
+	assert.Equal(t, float64(2), m.Value)
+	published := conn.broker.publishes()
+	require.Len(t, published, 1)
+	assert.Equal(t, deadLetterExchange, published[0].exchange)
+	assert.Equal(t, "device", published[0].key)
+	assert.Equal(t, []byte("not json"), published[0].msg.Body)
+	assert.Equal(t, failureMalformedPayload, published[0].msg.Headers[failureCategoryHeader])
+	assert.NotEmpty(t, published[0].msg.Headers[failureReasonHeader])
+	acked, _ := conn.broker.acknowledgements()
+	assert.Equal(t, []uint64{tag}, acked)
+	assert.NotContains(t, acked, next)
+}
+
+func TestRabbitMQMeasurementExchanger_RequeuesWhenDeadLetterIsNotConfirmed(t *testing.T) {
+	conn := newFakeRabbitMQConnection()
+	conn.broker.refuseConfirms = true
+	underTest, received := newConsumingFakeExchanger(t, conn)
+	defer underTest.Close()
+
+	tag := conn.channel.deliverRaw(amqp.Delivery{ContentType: contentTypeJSON, RoutingKey: "device", Body: []byte("not json")})
+	conn.channel.deliver(t, Measurement{Id: "device", Value: 2})
+	<-received
+
+	acked, requeued := conn.broker.acknowledgements()
+	assert.Empty(t, acked)
+	assert.Equal(t, []uint64{tag}, requeued)
+}
+
+func TestRabbitMQMeasurementExchanger_DeadLettersLeavesThemQueued(t *testing.T) {
+	conn := newFakeRabbitMQConnection()
+	deadLetteredAt := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	conn.broker.deadLetters = []amqp.Delivery{{
+		ContentType: contentTypeJSON,
+		RoutingKey:  "device",
+		Timestamp:   deadLetteredAt,
+		Headers: amqp.Table{
+			failureCategoryHeader: failureRetriesExhausted,
+			failureReasonHeader:   "mock error - write failed",
+			retryCountHeader:      int32(maxWriteRetries),
+		},
+		Body: []byte(`{"value":1}`),
+	}}
+	underTest, _ := newConsumingFakeExchanger(t, conn)
+	defer underTest.Close()
+
+	deadLetters, err := underTest.DeadLetters(10)
+
+	require.NoError(t, err)
+	assert.Equal(t, []DeadLetter{{
+		DeviceID:       "device",
+		ContentType:    contentTypeJSON,
+		Body:           `{"value":1}`,
+		Category:       failureRetriesExhausted,
+		Reason:         "mock error - write failed",
+		Retries:        maxWriteRetries,
+		DeadLetteredAt: deadLetteredAt,
+	}}, deadLetters)
+	assert.Equal(t, 1, conn.broker.queuedDeadLetters())
+}
+
+func TestRabbitMQMeasurementExchanger_ReplayDeadLettersClearsFailureHeaders(t *testing.T) {
+	conn := newFakeRabbitMQConnection()
+	conn.broker.deadLetters = []amqp.Delivery{{
+		ContentType: contentTypeJSON,
+		RoutingKey:  "device",
+		Headers: amqp.Table{
+			failureCategoryHeader: failureRetriesExhausted,
+			failureReasonHeader:   "mock error - write failed",
+			retryCountHeader:      int32(maxWriteRetries),
+			"x-custom":            "kept",
+		},
+		Body: []byte(`{"value":1}`),
+	}}
+	underTest, _ := newConsumingFakeExchanger(t, conn)
+	defer underTest.Close()
+
+	replayed, err := underTest.ReplayDeadLetters(10)
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	published := conn.broker.publishes()
+	require.Len(t, published, 1)
+	assert.Equal(t, "measurements", published[0].exchange)
+	assert.Equal(t, "device", published[0].key)
+	assert.Equal(t, amqp.Table{"x-custom": "kept"}, published[0].msg.Headers)
+	assert.Equal(t, 0, conn.broker.queuedDeadLetters())
+}
+
+func TestRabbitMQMeasurementExchanger_ReplayDeadLettersKeepsUnconfirmed(t *testing.T) {
+	conn := newFakeRabbitMQConnection()
+	conn.broker.refuseConfirms = true
+	conn.broker.deadLetters = []amqp.Delivery{{ContentType: contentTypeJSON, RoutingKey: "device", Body: []byte(`{"value":1}`)}}
+	underTest, _ := newConsumingFakeExchanger(t, conn)
+	defer underTest.Close()
+
+	replayed, err := underTest.ReplayDeadLetters(10)
+
+	assert.Equal(t, errPublishNotConfirmed, err)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, 1, conn.broker.queuedDeadLetters())
+}
+
+func newConsumingFakeExchanger(t *testing.T, conn *fakeRabbitMQConnection) (*rabbitMQMeasurementExchanger, <-chan Measurement) {
+	dialer := fakeRabbitMQDialer{results: []fakeDialResult{{conn: conn}}}
+	underTest := &rabbitMQMeasurementExchanger{dial: dialer.dial, after: time.After, closed: make(chan struct{})}
+	require.NoError(t, underTest.connect())
+
+	received, err := underTest.CreateReceiver()
+	require.NoError(t, err)
+
+	return underTest, received
+}
+
+type fakeDialResult struct {
+	conn *fakeRabbitMQConnection
+	err  error
+}
+
+type fakeRabbitMQDialer struct {
+	mu      sync.Mutex
+	results []fakeDialResult
+}
+
+func (d *fakeRabbitMQDialer) dial() (rabbitMQConnection, rabbitMQChannel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.results) == 0 {
+		return nil, nil, errors.New("mock error - no more connections")
+	}
+
+	result := d.results[0]
+	d.results = d.results[1:]
+	if result.err != nil {
+		return nil, nil, result.err
+	}
+
+	return result.conn, result.conn.channel, nil
+}
+
+// fakeRabbitMQConnection closes like amqp.Connection: dropping it notifies the
+// close listeners and closes the deliveries of its channel, and listeners
+// registered on a closed connection are closed right away. Channels opened on
+// it share the broker recording what was published and acknowledged.
+type fakeRabbitMQConnection struct {
+	mu        sync.Mutex
+	listeners []chan *amqp.Error
+	closed    bool
+	broker    *fakeRabbitMQBroker
+	channel   *fakeRabbitMQChannel
+}
+
+func newFakeRabbitMQConnection() *fakeRabbitMQConnection {
+	broker := &fakeRabbitMQBroker{}
+	return &fakeRabbitMQConnection{broker: broker, channel: broker.newChannel()}
+}
+
+func (c *fakeRabbitMQConnection) drop() {
+	c.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "mock error - connection dropped"})
+}
+
+func (c *fakeRabbitMQConnection) shutdown(err *amqp.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	for _, listener := range c.listeners {
+		if err != nil {
+			listener <- err
+		}
+		close(listener)
+	}
+	c.channel.close()
+}
+
+func (c *fakeRabbitMQConnection) Channel() (rabbitMQChannel, error) {
+	return c.broker.newChannel(), nil
+}
+
+func (c *fakeRabbitMQConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+
+	c.listeners = append(c.listeners, receiver)
+	return receiver
+}
+
+func (c *fakeRabbitMQConnection) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *fakeRabbitMQConnection) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+type fakePublishing struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+// fakeRabbitMQBroker records publishes and acknowledgements by delivery tag.
+// With refuseConfirms it nacks the publishes of channels in confirm mode.
+// Get takes messages from deadLetters, which are put back when the channel
+// closes without acknowledging them.
+type fakeRabbitMQBroker struct {
+	mu             sync.Mutex
+	refuseConfirms bool
+	published      []fakePublishing
+	deadLetters    []amqp.Delivery
+	lastTag        uint64
+	acked          []uint64
+	requeued       []uint64
+}
+
+func (b *fakeRabbitMQBroker) newChannel() *fakeRabbitMQChannel {
+	return &fakeRabbitMQChannel{broker: b, deliveries: make(chan amqp.Delivery)}
+}
+
+func (b *fakeRabbitMQBroker) publishes() []fakePublishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]fakePublishing(nil), b.published...)
+}
+
+func (b *fakeRabbitMQBroker) acknowledgements() (acked []uint64, requeued []uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]uint64(nil), b.acked...), append([]uint64(nil), b.requeued...)
+}
+
+func (b *fakeRabbitMQBroker) nextTag() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastTag++
+	return b.lastTag
+}
+
+func (b *fakeRabbitMQBroker) queuedDeadLetters() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.deadLetters)
+}
+
+type fakeRabbitMQChannel struct {
+	broker     *fakeRabbitMQBroker
+	mu         sync.Mutex
+	deliveries chan amqp.Delivery
+	closed     bool
+	confirms   chan amqp.Confirmation
+	published  uint64
+	unacked    map[uint64]amqp.Delivery
+}
+
+func (ch *fakeRabbitMQChannel) deliver(t *testing.T, m Measurement) uint64 {
+	return ch.deliverWithHeaders(t, m, nil)
+}
+
+func (ch *fakeRabbitMQChannel) deliverWithHeaders(t *testing.T, m Measurement, headers amqp.Table) uint64 {
+	body, err := encodeMeasurement(m)
+	require.NoError(t, err)
+
+	return ch.deliverRaw(amqp.Delivery{ContentType: contentTypeJSON, RoutingKey: m.Id, Headers: headers, Body: body})
+}
+
+func (ch *fakeRabbitMQChannel) deliverRaw(d amqp.Delivery) uint64 {
+	d.Acknowledger = ch
+	d.DeliveryTag = ch.broker.nextTag()
+	ch.deliveries <- d
+
+	return d.DeliveryTag
+}
+
+func (ch *fakeRabbitMQChannel) close() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if !ch.closed {
+		ch.closed = true
+		close(ch.deliveries)
+		if ch.confirms != nil {
+			close(ch.confirms)
+		}
+
+		ch.broker.mu.Lock()
+		for _, d := range ch.unacked {
+			ch.broker.deadLetters = append([]amqp.Delivery{d}, ch.broker.deadLetters...)
+		}
+		ch.broker.mu.Unlock()
+	}
+}
+
+func (ch *fakeRabbitMQChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return receiver
+}
+
+func (ch *fakeRabbitMQChannel) Consume(_, _ string, _, _, _, _ bool, _ amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	return ch.deliveries, nil
+}
+
+func (ch *fakeRabbitMQChannel) Publish(exchange, key string, _, _ bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.broker.mu.Lock()
+	ch.broker.published = append(ch.broker.published, fakePublishing{exchange: exchange, key: key, msg: msg})
+	refuse := ch.broker.refuseConfirms
+	ch.broker.mu.Unlock()
+
+	if ch.confirms != nil {
+		ch.published++
+		ch.confirms <- amqp.Confirmation{DeliveryTag: ch.published, Ack: !refuse}
+	}
+
+	return nil
+}
+
+func (ch *fakeRabbitMQChannel) Get(_ string, _ bool) (amqp.Delivery, bool, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.broker.mu.Lock()
+	defer ch.broker.mu.Unlock()
+
+	if len(ch.broker.deadLetters) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	d := ch.broker.deadLetters[0]
+	ch.broker.deadLetters = ch.broker.deadLetters[1:]
+	ch.broker.lastTag++
+	d.DeliveryTag = ch.broker.lastTag
+	d.Acknowledger = ch
+
+	if ch.unacked == nil {
+		ch.unacked = make(map[uint64]amqp.Delivery)
+	}
+	ch.unacked[d.DeliveryTag] = d
+
+	return d, true, nil
+}
+
+func (ch *fakeRabbitMQChannel) Confirm(_ bool) error {
+	return nil
+}
+
+func (ch *fakeRabbitMQChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.confirms = confirm
+	return confirm
+}
+
+func (ch *fakeRabbitMQChannel) Cancel(_ string, _ bool) error {
+	ch.close()
+	return nil
+}
+
+func (ch *fakeRabbitMQChannel) Close() error {
+	ch.close()
+	return nil
+}
+
+func (ch *fakeRabbitMQChannel) Ack(tag uint64, _ bool) error {
+	ch.mu.Lock()
+	delete(ch.unacked, tag)
+	ch.mu.Unlock()
+
+	ch.broker.mu.Lock()
+	defer ch.broker.mu.Unlock()
+
+	ch.broker.acked = append(ch.broker.acked, tag)
+	return nil
+}
+
+func (ch *fakeRabbitMQChannel) Nack(tag uint64, _ bool, requeue bool) error {
+	ch.broker.mu.Lock()
+	defer ch.broker.mu.Unlock()
+
+	if requeue {
+		ch.broker.requeued = append(ch.broker.requeued, tag)
+	}
+	return nil
+}
+
+func (ch *fakeRabbitMQChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxReplayFileSize keeps a replay file from filling the memory, it is read
+// whole and kept for as long as a device uses it.
+const maxReplayFileSize = 10 << 20
+
+var errReplayDisabled = errors.New("replay files are disabled, set TSM_REPLAY_DIR to enable them")
+
+// replayStore reads the CSV files of replay generators from dir. Clients only
+// name a file in dir, paths leading outside of it are refused. Values are
+// cached until the file changes, so validating and starting devices doesn't
+// read the same file again.
+type replayStore struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]replayFile
+}
+
+type replayFile struct {
+	modTime time.Time
+	size    int64
+	values  []float64
+}
+
+// newReplayStore returns nil, a store refusing every file, when dir is empty.
+func newReplayStore(dir string) *replayStore {
+	if dir == "" {
+		return nil
+	}
+
+	return &replayStore{dir: dir}
+}
+
+func (s *replayStore) values(name string) ([]float64, error) {
+	if s == nil {
+		return nil, errReplayDisabled
+	}
+
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("file %q not found", name)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("file %q is not a regular file", name)
+	}
+	if info.Size() > maxReplayFileSize {
+		return nil, fmt.Errorf("file %q is larger than %d bytes", name, maxReplayFileSize)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cached, ok := s.files[path]; ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.values, nil
+	}
+
+	values, err := readReplayValues(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.files == nil {
+		s.files = make(map[string]replayFile)
+	}
+	s.files[path] = replayFile{modTime: info.ModTime(), size: info.Size(), values: values}
+
+	return values, nil
+}
+
+// path resolves name in the replay directory, following symlinks, and
+// refuses names that end up outside of it.
+func (s *replayStore) path(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("requires file")
+	}
+
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", errors.New("file has to be a name in the replay directory, not an absolute path")
+	}
+
+	for _, element := range strings.Split(filepath.ToSlash(name), "/") {
+		if element == ".." {
+			return "", errors.New("file can't contain ..")
+		}
+	}
+
+	dir, err := filepath.EvalSymlinks(s.dir)
+	if err != nil {
+		return "", fmt.Errorf("replay directory: %w", err)
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("file %q not found", name)
+	}
+
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %q is outside of the replay directory", name)
+	}
+
+	return path, nil
+}
+
+// readReplayValues reads the last column of every CSV record. A first record
+// that doesn't hold a number is treated as a header.
+func readReplayValues(path string) ([]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the file may have grown since it was checked
+	limited := &io.LimitedReader{R: file, N: maxReplayFileSize + 1}
+	reader := csv.NewReader(limited)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if limited.N == 0 {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxReplayFileSize)
+	}
+
+	values := make([]float64, 0, len(records))
+	for i, record := range records {
+		value, err := strconv.ParseFloat(strings.TrimSpace(record[len(record)-1]), 64)
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		values = append(values, value)
+	}
+
+	if len(values) == 0 {
+		return nil, errors.New("file holds no values")
+	}
+
+	return values, nil
+}
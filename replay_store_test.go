@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayStore_RefusesFilesOutsideOfDirectory(t *testing.T) {
+	dir := writeReplayFile(t, "values.csv", "1\n2\n")
+	outside := writeReplayFile(t, "secret.csv", "42\n")
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.csv"), filepath.Join(dir, "link.csv")))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested"), 0755))
+
+	testCases := map[string]string{
+		"empty":             "",
+		"absolute":          filepath.Join(outside, "secret.csv"),
+		"parent":            "../" + filepath.Base(outside) + "/secret.csv",
+		"nested parent":     "nested/../../" + filepath.Base(outside) + "/secret.csv",
+		"symlink outside":   "link.csv",
+		"not regular file":  "nested",
+		"device file":       "/dev/zero",
+		"missing file":      "missing.csv",
+		"missing directory": "missing/values.csv",
+	}
+
+	underTest := newReplayStore(dir)
+
+	for name, file := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := underTest.values(file)
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReplayStore_RefusesLargeFiles(t *testing.T) {
+	dir := writeReplayFile(t, "large.csv", strings.Repeat("1\n", maxReplayFileSize/2+1))
+
+	_, err := newReplayStore(dir).values("large.csv")
+
+	assert.Error(t, err)
+}
+
+func TestReplayStore_DisabledWithoutDirectory(t *testing.T) {
+	_, err := newReplayStore("").values("values.csv")
+
+	assert.Equal(t, errReplayDisabled, err)
+}
+
+func TestReplayStore_ReadsFileAgainOnlyWhenChanged(t *testing.T) {
+	dir := writeReplayFile(t, "values.csv", "1\n2\n")
+	underTest := newReplayStore(dir)
+
+	first, err := underTest.values("values.csv")
+	require.NoError(t, err)
+	cached, err := underTest.values("values.csv")
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "values.csv"), []byte("3\n4\n5\n"), 0644))
+	changed, err := underTest.values("values.csv")
+	require.NoError(t, err)
+
+	assert.Equal(t, []float64{1, 2}, first)
+	assert.Same(t, &first[0], &cached[0])
+	assert.Equal(t, []float64{3, 4, 5}, changed)
+}
@@ -2,18 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/gorilla/mux"
 	"log"
 	"net/http"
-	"time"
 )
 
 type tickerHTTPHandler struct {
 	ts *TickerService
 }
 
-func newTickerHTTPHandler(ds *DeviceService, publisher measurementPublisher) tickerHTTPHandler {
-	ts := TickerService{ds: ds, publisher: publisher, tf: time.Tick}
+func newTickerHTTPHandler(ds *DeviceService, publisher measurementPublisher, store tickerStateStore) tickerHTTPHandler {
+	ts := TickerService{ds: ds, publisher: publisher, store: store, tf: newTimeTicker}
 	ds.AddObserver(&ts)
+	ds.AddUpdateObserver(&ts)
+	ds.AddDeleteObserver(&ts)
 
 	return tickerHTTPHandler{ts: &ts}
 }
@@ -21,14 +23,13 @@ func newTickerHTTPHandler(ds *DeviceService, publisher measurementPublisher) tic
 func (h *tickerHTTPHandler) Start(w http.ResponseWriter, r *http.Request) {
 	if err := h.ts.Start(r.Context()); err != nil {
 		log.Print(err)
-		http.Error(w, "failed to start ticker", http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusInternalServerError, "failed to start ticker")
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode("ticker started"); err != nil {
 		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -38,6 +39,69 @@ func (h *tickerHTTPHandler) Stop(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode("ticker stopped"); err != nil {
 		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *tickerHTTPHandler) GetStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.ts.Status()); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *tickerHTTPHandler) GetDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.getDevice(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.ts.DeviceTickerStatus(device.ID.Hex())); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *tickerHTTPHandler) StartDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.getDevice(w, r)
+	if !ok {
+		return
+	}
+
+	h.ts.StartDevice(*device)
+	h.writeDeviceStatus(w, device)
+}
+
+func (h *tickerHTTPHandler) StopDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.getDevice(w, r)
+	if !ok {
+		return
+	}
+
+	h.ts.StopDevice(device.ID.Hex())
+	h.writeDeviceStatus(w, device)
+}
+
+func (h *tickerHTTPHandler) getDevice(w http.ResponseWriter, r *http.Request) (*Device, bool) {
+	id := mux.Vars(r)["id"]
+
+	device, err := h.ts.ds.GetByID(r.Context(), id)
+	if err != nil {
+		log.Print(err)
+		writeError(w, r, err)
+		return nil, false
+	}
+
+	return device, true
+}
+
+func (h *tickerHTTPHandler) writeDeviceStatus(w http.ResponseWriter, device *Device) {
+	device.Status = h.ts.DeviceStatus(device.ID.Hex())
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(device); err != nil {
+		log.Print(err)
 	}
 }
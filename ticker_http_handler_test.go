@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStopDeviceReturnsPausedDevice(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "device", Interval: Interval(time.Second), Value: 1}}}
+	underTest := newTickerHTTPHandler(&DeviceService{dao: &dao}, nil, &inMemoryTickerStateStore{})
+	req := createDeviceRequest(http.MethodPost, id.Hex(), "")
+	res := httptest.NewRecorder()
+
+	underTest.StopDevice(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, fmt.Sprintf(`{"id":"%v","name":"device","interval":"1s","value":1,"status":"paused"}`, id.Hex()), res.Body.String())
+}
+
+func TestStartDeviceWhenTickersNotStartedReturnsStoppedDevice(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "device", Interval: Interval(time.Second), Value: 1}}}
+	underTest := newTickerHTTPHandler(&DeviceService{dao: &dao}, nil, &inMemoryTickerStateStore{})
+	req := createDeviceRequest(http.MethodPost, id.Hex(), "")
+	res := httptest.NewRecorder()
+
+	underTest.StartDevice(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, fmt.Sprintf(`{"id":"%v","name":"device","interval":"1s","value":1,"status":"stopped"}`, id.Hex()), res.Body.String())
+}
+
+func TestStartStopDeviceNotFound(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+	underTest := newTickerHTTPHandler(&DeviceService{dao: &inMemoryDeviceDAO{}}, nil, &inMemoryTickerStateStore{})
+
+	startRes := httptest.NewRecorder()
+	underTest.StartDevice(startRes, createDeviceRequest(http.MethodPost, id, ""))
+
+	stopRes := httptest.NewRecorder()
+	underTest.StopDevice(stopRes, createDeviceRequest(http.MethodPost, id, ""))
+
+	assert.Equal(t, http.StatusNotFound, startRes.Code)
+	assert.Equal(t, http.StatusNotFound, stopRes.Code)
+}
+
+func TestGetTickerStatusWhenNotStarted(t *testing.T) {
+	underTest := newTickerHTTPHandler(&DeviceService{dao: &inMemoryDeviceDAO{}}, nil, &inMemoryTickerStateStore{})
+	res := httptest.NewRecorder()
+
+	underTest.GetStatus(res, httptest.NewRequest(http.MethodGet, "/ticker", nil))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, `{"running":false,"devices":[]}`, res.Body.String())
+}
+
+func TestGetDeviceTickerStatus(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Name: "device", Interval: Interval(time.Second), Value: 1}}}
+	underTest := newTickerHTTPHandler(&DeviceService{dao: &dao}, nil, &inMemoryTickerStateStore{})
+	res := httptest.NewRecorder()
+
+	underTest.GetDeviceStatus(res, createDeviceRequest(http.MethodGet, id.Hex(), ""))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	require.JSONEq(t, fmt.Sprintf(`{"deviceId":"%v","status":"stopped","publishCount":0}`, id.Hex()), res.Body.String())
+}
+
+func TestGetDeviceTickerStatusNotFound(t *testing.T) {
+	underTest := newTickerHTTPHandler(&DeviceService{dao: &inMemoryDeviceDAO{}}, nil, &inMemoryTickerStateStore{})
+	res := httptest.NewRecorder()
+
+	underTest.GetDeviceStatus(res, createDeviceRequest(http.MethodGet, primitive.NewObjectID().Hex(), ""))
+
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
@@ -4,57 +4,323 @@ import (
 	"context"
 	"errors"
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
-type tickerFactory func(d time.Duration) <-chan time.Time
-type measurementPublisher func(id string, value float64) error
+// tickerFactory returns the channel of ticks and a function releasing the
+// ticker, called when the device ticker stops.
+type tickerFactory func(d time.Duration) (<-chan time.Time, func())
+type measurementPublisher func(m Measurement) error
+
+const (
+	deviceStatusRunning = "running"
+	deviceStatusStopped = "stopped"
+	deviceStatusPaused  = "paused"
+)
+
+// tickerState is the part of TickerService state that survives restarts.
+type tickerState struct {
+	Running       bool     `bson:"running"`
+	PausedDevices []string `bson:"pausedDevices,omitempty"`
+}
+
+// stateSaveTimeout bounds a save of the ticker state, which doesn't depend on
+// the request that changed the state.
+const stateSaveTimeout = 5 * time.Second
+
+type tickerStateStore interface {
+	Load(ctx context.Context) (tickerState, error)
+	Save(ctx context.Context, state tickerState) error
+}
+
+type TickerStatus struct {
+	Running   bool                 `json:"running"`
+	StartedAt *time.Time           `json:"startedAt,omitempty"`
+	Devices   []DeviceTickerStatus `json:"devices"`
+}
+
+type DeviceTickerStatus struct {
+	DeviceID        string     `json:"deviceId"`
+	Status          string     `json:"status"`
+	LastPublishedAt *time.Time `json:"lastPublishedAt,omitempty"`
+	PublishCount    uint64     `json:"publishCount"`
+	LastError       string     `json:"lastError,omitempty"`
+	NextTickAt      *time.Time `json:"nextTickAt,omitempty"`
+}
+
+type deviceTickerStats struct {
+	lastPublishedAt time.Time
+	publishCount    uint64
+	lastError       string
+	nextTickAt      time.Time
+}
 
 type TickerService struct {
 	mu        sync.Mutex
 	ds        *DeviceService
 	tf        tickerFactory
 	publisher measurementPublisher
-	stop      chan bool
+	store     tickerStateStore
+	tickers   map[string]chan bool
+	paused    map[string]bool
+	stats     map[string]*deviceTickerStats
+	wg        sync.WaitGroup
 	isRunning bool
+	startedAt time.Time
+
+	// saveMu orders saves of the state snapshots taken under mu. stateSeq
+	// numbers the snapshots and savedSeq is the last one saved, so an older
+	// snapshot never overwrites a newer one.
+	saveMu   sync.Mutex
+	stateSeq uint64
+	savedSeq uint64
+}
+
+// tickerStateSnapshot is the state to save, taken while mu is held. The zero
+// snapshot saves nothing.
+type tickerStateSnapshot struct {
+	seq   uint64
+	state tickerState
+}
+
+// Restore brings back the paused devices and starts the tickers if they were
+// running when the state was last saved.
+func (ts *TickerService) Restore(ctx context.Context) error {
+	if ts.store == nil {
+		return nil
+	}
+
+	state, err := ts.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	ts.paused = make(map[string]bool, len(state.PausedDevices))
+	for _, id := range state.PausedDevices {
+		ts.paused[id] = true
+	}
+	ts.mu.Unlock()
+
+	if !state.Running {
+		return nil
+	}
+
+	log.Println("restoring measurements sending")
+	return ts.Start(ctx)
 }
 
 func (ts *TickerService) Start(ctx context.Context) error {
+	snapshot, err := ts.start(ctx)
+	if err != nil {
+		return err
+	}
+
+	ts.saveState(snapshot)
+	return nil
+}
+
+func (ts *TickerService) start(ctx context.Context) (tickerStateSnapshot, error) {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
 	if ts.isRunning {
 		log.Println("tickers started already")
-		return nil
+		return tickerStateSnapshot{}, nil
 	}
 
-	devices, err := ts.ds.GetAll(ctx, 0, 0)
+	var devices []Device
+	err := ts.ds.ForEach(ctx, DeviceQuery{}, func(device Device) error {
+		devices = append(devices, device)
+		return nil
+	})
 	if err != nil {
 		log.Print(err)
-		return errors.New("failed to start measurements sending")
+		return tickerStateSnapshot{}, errors.New("failed to start measurements sending")
 	}
 
-	ts.stop = make(chan bool)
+	ts.tickers = make(map[string]chan bool, len(devices))
 	ts.isRunning = true
+	ts.startedAt = time.Now()
 
 	for _, device := range devices {
-		go func(d Device) {
-			ts.createTickerForDevice(d)
-		}(device)
+		if !ts.paused[device.ID.Hex()] {
+			ts.startTicker(device)
+		}
 	}
 
-	return nil
+	return ts.snapshotState(), nil
 }
 
+// Stop cancels all device tickers, remembers that they are stopped and waits
+// until none of them is publishing.
 func (ts *TickerService) Stop() {
+	var snapshot tickerStateSnapshot
+	ts.mu.Lock()
+	if ts.isRunning {
+		ts.stopAll()
+		snapshot = ts.snapshotState()
+	}
+	ts.mu.Unlock()
+
+	ts.saveState(snapshot)
+	ts.wg.Wait()
+}
+
+// Shutdown cancels all device tickers like Stop, but keeps the saved state,
+// so the tickers are restored on the next start of the service.
+func (ts *TickerService) Shutdown() {
+	ts.mu.Lock()
+	if ts.isRunning {
+		ts.stopAll()
+	}
+	ts.mu.Unlock()
+
+	ts.wg.Wait()
+}
+
+// StartDevice resumes publishing of a device stopped with StopDevice. The
+// device ticker runs only while the tickers are started.
+func (ts *TickerService) StartDevice(device Device) {
+	ts.mu.Lock()
+	id := device.ID.Hex()
+	delete(ts.paused, id)
+
+	if _, ok := ts.tickers[id]; ts.isRunning && !ok {
+		ts.startTicker(device)
+	}
+
+	snapshot := ts.snapshotState()
+	ts.mu.Unlock()
+
+	ts.saveState(snapshot)
+}
+
+// StopDevice mutes a single device until StartDevice is called for it, also
+// across Start and Stop of all tickers.
+func (ts *TickerService) StopDevice(id string) {
+	ts.mu.Lock()
+	if ts.paused == nil {
+		ts.paused = make(map[string]bool)
+	}
+	ts.paused[id] = true
+	ts.stopTicker(id)
+
+	snapshot := ts.snapshotState()
+	ts.mu.Unlock()
+
+	ts.saveState(snapshot)
+}
+
+func (ts *TickerService) DeviceStatus(id string) string {
+	return ts.DeviceTickerStatus(id).Status
+}
+
+func (ts *TickerService) Status() TickerStatus {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
+	status := TickerStatus{Running: ts.isRunning, Devices: make([]DeviceTickerStatus, 0, len(ts.stats))}
 	if ts.isRunning {
-		log.Println("stopping send measurements")
-		close(ts.stop)
-		ts.isRunning = false
+		startedAt := ts.startedAt
+		status.StartedAt = &startedAt
+	}
+
+	ids := make([]string, 0, len(ts.stats))
+	for id := range ts.stats {
+		ids = append(ids, id)
+	}
+	for id := range ts.paused {
+		if _, ok := ts.stats[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		status.Devices = append(status.Devices, ts.deviceTickerStatus(id))
+	}
+
+	return status
+}
+
+func (ts *TickerService) DeviceTickerStatus(id string) DeviceTickerStatus {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.deviceTickerStatus(id)
+}
+
+func (ts *TickerService) deviceTickerStatus(id string) DeviceTickerStatus {
+	status := DeviceTickerStatus{DeviceID: id, Status: deviceStatusStopped}
+
+	_, running := ts.tickers[id]
+	if running {
+		status.Status = deviceStatusRunning
+	} else if ts.paused[id] {
+		status.Status = deviceStatusPaused
+	}
+
+	stats, ok := ts.stats[id]
+	if !ok {
+		return status
+	}
+
+	status.PublishCount = stats.publishCount
+	status.LastError = stats.lastError
+	if !stats.lastPublishedAt.IsZero() {
+		lastPublishedAt := stats.lastPublishedAt
+		status.LastPublishedAt = &lastPublishedAt
+	}
+	if running {
+		nextTickAt := stats.nextTickAt
+		status.NextTickAt = &nextTickAt
+	}
+
+	return status
+}
+
+func (ts *TickerService) stopAll() {
+	log.Println("stopping send measurements")
+	for id := range ts.tickers {
+		ts.stopTicker(id)
+	}
+	ts.isRunning = false
+}
+
+func (ts *TickerService) snapshotState() tickerStateSnapshot {
+	var paused []string
+	for id := range ts.paused {
+		paused = append(paused, id)
+	}
+	sort.Strings(paused)
+
+	ts.stateSeq++
+	return tickerStateSnapshot{seq: ts.stateSeq, state: tickerState{Running: ts.isRunning, PausedDevices: paused}}
+}
+
+// saveState stores a snapshot unless a newer one was saved already. It is
+// called without ts.mu held, so a slow store doesn't hold up the tickers.
+func (ts *TickerService) saveState(snapshot tickerStateSnapshot) {
+	if ts.store == nil {
+		return
+	}
+
+	ts.saveMu.Lock()
+	defer ts.saveMu.Unlock()
+
+	if snapshot.seq <= ts.savedSeq {
+		return
+	}
+	ts.savedSeq = snapshot.seq
+
+	ctx, cancel := context.WithTimeout(context.Background(), stateSaveTimeout)
+	defer cancel()
+
+	if err := ts.store.Save(ctx, snapshot.state); err != nil {
+		log.Printf("failed to save ticker state: %v", err)
 	}
 }
 
@@ -67,22 +333,130 @@ func (ts *TickerService) NotifyDeviceCreated(device Device) {
 		return
 	}
 
-	go ts.createTickerForDevice(device)
+	ts.startTicker(device)
+}
+
+// NotifyDeviceUpdated restarts the ticker of a device the service knows, i.e.
+// one that has a ticker or whose generator failed. An update notified after
+// the device was deleted doesn't bring its ticker back.
+func (ts *TickerService) NotifyDeviceUpdated(device Device) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	id := device.ID.Hex()
+	if _, known := ts.stats[id]; !ts.isRunning || !known || ts.paused[id] {
+		return
+	}
+
+	ts.startTicker(device)
+}
+
+func (ts *TickerService) NotifyDeviceDeleted(id string) {
+	var snapshot tickerStateSnapshot
+	ts.mu.Lock()
+	ts.stopTicker(id)
+	delete(ts.stats, id)
+
+	if ts.paused[id] {
+		delete(ts.paused, id)
+		snapshot = ts.snapshotState()
+	}
+	ts.mu.Unlock()
+
+	ts.saveState(snapshot)
 }
 
-func (ts *TickerService) createTickerForDevice(device Device) {
-	sendTrigger := ts.tf(time.Second * time.Duration(device.Interval))
+// startTicker, stopTicker, stopAll, snapshotState and deviceTickerStatus have
+// to be called with ts.mu held. startTicker replaces a running ticker of the
+// device, as Start and NotifyDeviceCreated may both see a new device.
+func (ts *TickerService) startTicker(device Device) {
+	ts.stopTicker(device.ID.Hex())
+
+	if ts.stats == nil {
+		ts.stats = make(map[string]*deviceTickerStats)
+	}
+	stats, ok := ts.stats[device.ID.Hex()]
+	if !ok {
+		stats = &deviceTickerStats{}
+		ts.stats[device.ID.Hex()] = stats
+	}
+
+	// a device without a generator is never registered, so it isn't reported
+	// as running
+	generator, err := newValueGenerator(device, ts.ds.replay)
+	if err != nil {
+		log.Printf("ticker for device %v not started: %v", device.ID, err)
+		stats.lastError = err.Error()
+		return
+	}
+
+	stop := make(chan bool)
+	ts.tickers[device.ID.Hex()] = stop
+	stats.nextTickAt = time.Now().Add(device.Interval.Duration())
+	activeDeviceTickers.Set(float64(len(ts.tickers)))
+
+	ts.wg.Add(1)
+	go func() {
+		defer ts.wg.Done()
+		ts.createTickerForDevice(device, generator, stop)
+	}()
+}
+
+func (ts *TickerService) stopTicker(id string) {
+	if stop, ok := ts.tickers[id]; ok {
+		close(stop)
+		delete(ts.tickers, id)
+		activeDeviceTickers.Set(float64(len(ts.tickers)))
+	}
+}
+
+func (ts *TickerService) createTickerForDevice(device Device, generator ValueGenerator, stop <-chan bool) {
+	sendTrigger, stopTrigger := ts.tf(device.Interval.Duration())
+	defer stopTrigger()
 	defer log.Printf("ticker for device %v stopped", device.ID)
 
+	var seq uint64
 	for {
 		select {
-		case <-sendTrigger:
-			if err := ts.publisher(device.ID.Hex(), device.Value); err != nil {
+		case tick := <-sendTrigger:
+			seq++
+			m := Measurement{Id: device.ID.Hex(), Value: generator.Next(tick), Time: tick, Seq: seq, Unit: device.Unit, Tags: device.Tags}
+			err := ts.publisher(m)
+			if err != nil {
 				log.Print(err)
+				measurementPublishErrorsTotal.Inc()
+			} else {
+				measurementsPublishedTotal.Inc()
 			}
-		case <-ts.stop:
+			ts.recordPublish(device, stop, tick, err)
+		case <-stop:
 			log.Printf("measurements sending from device %v stopped", device.ID)
 			return
 		}
 	}
 }
+
+func newTimeTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+func (ts *TickerService) recordPublish(device Device, stop <-chan bool, tick time.Time, err error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	id := device.ID.Hex()
+	if current, ok := ts.tickers[id]; !ok || current != stop {
+		return
+	}
+
+	stats := ts.stats[id]
+	stats.nextTickAt = tick.Add(device.Interval.Duration())
+	if err != nil {
+		stats.lastError = err.Error()
+		return
+	}
+
+	stats.lastPublishedAt = tick
+	stats.publishCount++
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"testing"
 	"time"
@@ -10,15 +12,15 @@ import (
 
 func TestTickerService_Start_SendDeviceMeasurement(t *testing.T) {
 	id := primitive.NewObjectID()
-	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: 1, Value: 5}}}
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: Interval(time.Second), Value: 5}}}
 	ds := DeviceService{dao: &dao}
 	measurements := make(chan Measurement)
 	sendTrigger := make(chan time.Time)
 
 	underTest := TickerService{
 		ds:        &ds,
-		publisher: func(id string, value float64) error { measurements <- Measurement{Id: id, Value: value}; return nil },
-		tf:        func(d time.Duration) <-chan time.Time { return sendTrigger },
+		publisher: func(m Measurement) error { measurements <- m; return nil },
+		tf:        func(d time.Duration) (<-chan time.Time, func()) { return sendTrigger, func() {} },
 	}
 	defer underTest.Stop()
 
@@ -26,5 +28,455 @@ func TestTickerService_Start_SendDeviceMeasurement(t *testing.T) {
 	sendTrigger <- time.Time{}
 	result := <-measurements
 
-	assert.Equal(t, Measurement{Id: id.Hex(), Value: 5}, result)
+	assert.Equal(t, Measurement{Id: id.Hex(), Value: 5, Seq: 1}, result)
+}
+
+func TestTickerService_Start_SendsDeviceUnitAndTags(t *testing.T) {
+	id := primitive.NewObjectID()
+	tags := map[string]string{"site": "krk"}
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: Interval(time.Second), Value: 5, Unit: "kWh", Tags: tags}}}
+	ds := DeviceService{dao: &dao}
+	measurements := make(chan Measurement)
+	sendTrigger := make(chan time.Time)
+
+	underTest := TickerService{
+		ds:        &ds,
+		publisher: func(m Measurement) error { measurements <- m; return nil },
+		tf:        func(d time.Duration) (<-chan time.Time, func()) { return sendTrigger, func() {} },
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	sendTrigger <- time.Time{}
+	result := <-measurements
+
+	assert.Equal(t, Measurement{Id: id.Hex(), Value: 5, Seq: 1, Unit: "kWh", Tags: tags}, result)
+}
+
+func TestTickerService_Start_StampsMeasurementsWithTickTimeAndSequence(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: Interval(time.Second), Value: 5}}}
+	ds := DeviceService{dao: &dao}
+	measurements := make(chan Measurement)
+	sendTrigger := make(chan time.Time)
+	firstTick := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	underTest := TickerService{
+		ds:        &ds,
+		publisher: func(m Measurement) error { measurements <- m; return nil },
+		tf:        func(d time.Duration) (<-chan time.Time, func()) { return sendTrigger, func() {} },
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	sendTrigger <- firstTick
+	first := <-measurements
+	sendTrigger <- firstTick.Add(time.Second)
+	second := <-measurements
+
+	assert.Equal(t, Measurement{Id: id.Hex(), Value: 5, Time: firstTick, Seq: 1}, first)
+	assert.Equal(t, Measurement{Id: id.Hex(), Value: 5, Time: firstTick.Add(time.Second), Seq: 2}, second)
+}
+
+func TestTickerService_NotifyDeviceUpdated_RestartsOnlyUpdatedDevice(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: Interval(time.Second), Value: 5}}}
+	ds := DeviceService{dao: &dao}
+	measurements := make(chan Measurement)
+	triggers := make(chan chan time.Time, 2)
+
+	underTest := TickerService{
+		ds:        &ds,
+		publisher: func(m Measurement) error { measurements <- m; return nil },
+		tf:        newRecordingTickerFactory(triggers),
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	oldTrigger := <-triggers
+
+	underTest.NotifyDeviceUpdated(Device{ID: id, Interval: Interval(2 * time.Second), Value: 7})
+	newTrigger := <-triggers
+	newTrigger <- time.Time{}
+	result := <-measurements
+
+	assert.Equal(t, Measurement{Id: id.Hex(), Value: 7, Seq: 1}, result)
+	assertTriggerNotConsumed(t, oldTrigger)
+}
+
+func TestTickerService_ReleasesTickerWhenDeviceTickerStops(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: Interval(time.Second), Value: 5}}}
+	released := make(chan bool, 2)
+
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &dao},
+		publisher: func(m Measurement) error { return nil },
+		tf: func(d time.Duration) (<-chan time.Time, func()) {
+			return nil, func() { released <- true }
+		},
+	}
+
+	_ = underTest.Start(context.Background())
+	underTest.NotifyDeviceUpdated(Device{ID: id, Interval: Interval(2 * time.Second), Value: 7})
+	underTest.Stop()
+
+	assert.Len(t, released, 2)
+}
+
+func TestTickerService_NotifyDeviceDeleted_StopsOnlyDeletedDevice(t *testing.T) {
+	deletedID := primitive.NewObjectID()
+	keptID := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: deletedID, Interval: Interval(time.Second), Value: 5}}}
+	ds := DeviceService{dao: &dao}
+	measurements := make(chan Measurement)
+	triggers := make(chan chan time.Time, 2)
+
+	underTest := TickerService{
+		ds:        &ds,
+		publisher: func(m Measurement) error { measurements <- m; return nil },
+		tf:        newRecordingTickerFactory(triggers),
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	deletedTrigger := <-triggers
+	underTest.NotifyDeviceCreated(Device{ID: keptID, Interval: Interval(time.Second), Value: 6})
+	keptTrigger := <-triggers
+
+	underTest.NotifyDeviceDeleted(deletedID.Hex())
+	keptTrigger <- time.Time{}
+	result := <-measurements
+
+	assert.Equal(t, Measurement{Id: keptID.Hex(), Value: 6, Seq: 1}, result)
+	assertTriggerNotConsumed(t, deletedTrigger)
+}
+
+func TestTickerService_NotifyDeviceCreated_ReplacesTickerStartedByStart(t *testing.T) {
+	id := primitive.NewObjectID()
+	device := Device{ID: id, Interval: Interval(time.Second), Value: 5}
+	dao := inMemoryDeviceDAO{devices: []Device{device}}
+	triggers := make(chan chan time.Time, 2)
+
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &dao},
+		publisher: func(m Measurement) error { return nil },
+		tf:        newRecordingTickerFactory(triggers),
+	}
+
+	_ = underTest.Start(context.Background())
+	firstTrigger := <-triggers
+	underTest.NotifyDeviceCreated(device)
+	<-triggers
+
+	stopped := make(chan bool)
+	go func() {
+		underTest.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		require.Fail(t, "Stop should not wait for a replaced ticker")
+	}
+	assertTriggerNotConsumed(t, firstTrigger)
+}
+
+func TestTickerService_NotifyDeviceUpdated_IgnoresDeletedDevice(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: Interval(time.Second), Value: 5}}}
+	triggers := make(chan chan time.Time, 2)
+
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &dao},
+		publisher: func(m Measurement) error { return nil },
+		tf:        newRecordingTickerFactory(triggers),
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	<-triggers
+	underTest.NotifyDeviceDeleted(id.Hex())
+	underTest.NotifyDeviceUpdated(Device{ID: id, Interval: Interval(2 * time.Second), Value: 7})
+
+	assert.Empty(t, triggers)
+	assert.Equal(t, deviceStatusStopped, underTest.DeviceStatus(id.Hex()))
+}
+
+func TestTickerService_NotifyDeviceUpdated_RestartsDeviceWithFailedGenerator(t *testing.T) {
+	id := primitive.NewObjectID()
+	broken := Device{ID: id, Interval: Interval(time.Second), Generator: &GeneratorConfig{Type: generatorReplay, File: "values.csv"}}
+	dao := inMemoryDeviceDAO{devices: []Device{broken}}
+	triggers := make(chan chan time.Time, 1)
+
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &dao},
+		publisher: func(m Measurement) error { return nil },
+		tf:        newRecordingTickerFactory(triggers),
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	underTest.NotifyDeviceUpdated(Device{ID: id, Interval: Interval(time.Second), Value: 7})
+	<-triggers
+
+	assert.Equal(t, deviceStatusRunning, underTest.DeviceStatus(id.Hex()))
+}
+
+func TestTickerService_PersistsRunningState(t *testing.T) {
+	store := inMemoryTickerStateStore{}
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &inMemoryDeviceDAO{}},
+		publisher: func(m Measurement) error { return nil },
+		tf:        func(d time.Duration) (<-chan time.Time, func()) { return nil, func() {} },
+		store:     &store,
+	}
+
+	_ = underTest.Start(context.Background())
+	assert.Equal(t, tickerState{Running: true}, store.state)
+
+	underTest.Shutdown()
+	assert.Equal(t, tickerState{Running: true}, store.state, "shutdown should keep state for restore")
+
+	_ = underTest.Start(context.Background())
+	underTest.Stop()
+	assert.Equal(t, tickerState{Running: false}, store.state)
+}
+
+func TestTickerService_SavesStateWithoutBlockingStatus(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+	store := blockingTickerStateStore{saving: make(chan context.Context), release: make(chan bool)}
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &inMemoryDeviceDAO{}},
+		publisher: func(m Measurement) error { return nil },
+		tf:        func(d time.Duration) (<-chan time.Time, func()) { return nil, func() {} },
+		store:     &store,
+	}
+
+	go underTest.StopDevice(id)
+	<-store.saving
+
+	status := make(chan string)
+	go func() { status <- underTest.DeviceStatus(id) }()
+
+	select {
+	case result := <-status:
+		assert.Equal(t, deviceStatusPaused, result)
+	case <-time.After(time.Second):
+		assert.Fail(t, "status should not wait for the state to be saved")
+	}
+	close(store.release)
+}
+
+func TestTickerService_SavesStateIndependentlyOfRequestContext(t *testing.T) {
+	store := blockingTickerStateStore{saving: make(chan context.Context), release: make(chan bool)}
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &inMemoryDeviceDAO{}},
+		publisher: func(m Measurement) error { return nil },
+		tf:        func(d time.Duration) (<-chan time.Time, func()) { return nil, func() {} },
+		store:     &store,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	go func() { _ = underTest.Start(ctx) }()
+	saveCtx := <-store.saving
+
+	assert.NoError(t, saveCtx.Err())
+	_, hasDeadline := saveCtx.Deadline()
+	assert.True(t, hasDeadline)
+	close(store.release)
+}
+
+// blockingTickerStateStore hands the context of every save to saving and
+// doesn't return until release is closed.
+type blockingTickerStateStore struct {
+	saving  chan context.Context
+	release chan bool
+}
+
+func (store *blockingTickerStateStore) Load(_ context.Context) (tickerState, error) {
+	return tickerState{}, nil
+}
+
+func (store *blockingTickerStateStore) Save(ctx context.Context, _ tickerState) error {
+	store.saving <- ctx
+	<-store.release
+	return nil
+}
+
+func TestTickerService_Restore_StartsTickersWhenSavedAsRunning(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: Interval(time.Second), Value: 5}}}
+	measurements := make(chan Measurement)
+	sendTrigger := make(chan time.Time)
+
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &dao},
+		publisher: func(m Measurement) error { measurements <- m; return nil },
+		tf:        func(d time.Duration) (<-chan time.Time, func()) { return sendTrigger, func() {} },
+		store:     &inMemoryTickerStateStore{state: tickerState{Running: true}},
+	}
+	defer underTest.Stop()
+
+	require.NoError(t, underTest.Restore(context.Background()))
+	sendTrigger <- time.Time{}
+	result := <-measurements
+
+	assert.Equal(t, id.Hex(), result.Id)
+}
+
+func TestTickerService_Restore_KeepsTickersStoppedWhenSavedAsStopped(t *testing.T) {
+	underTest := TickerService{
+		ds:    &DeviceService{dao: &inMemoryDeviceDAO{}},
+		store: &inMemoryTickerStateStore{},
+	}
+
+	require.NoError(t, underTest.Restore(context.Background()))
+
+	assert.False(t, underTest.isRunning)
+}
+
+func TestTickerService_StopDevice_MutesOnlyThatDevice(t *testing.T) {
+	stoppedID := primitive.NewObjectID()
+	keptID := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: stoppedID, Interval: Interval(time.Second), Value: 5}}}
+	measurements := make(chan Measurement)
+	triggers := make(chan chan time.Time, 2)
+	store := inMemoryTickerStateStore{}
+
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &dao},
+		publisher: func(m Measurement) error { measurements <- m; return nil },
+		tf:        newRecordingTickerFactory(triggers),
+		store:     &store,
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	stoppedTrigger := <-triggers
+	underTest.NotifyDeviceCreated(Device{ID: keptID, Interval: Interval(time.Second), Value: 6})
+	keptTrigger := <-triggers
+
+	underTest.StopDevice(stoppedID.Hex())
+	keptTrigger <- time.Time{}
+	result := <-measurements
+
+	assert.Equal(t, keptID.Hex(), result.Id)
+	assertTriggerNotConsumed(t, stoppedTrigger)
+	assert.Equal(t, deviceStatusPaused, underTest.DeviceStatus(stoppedID.Hex()))
+	assert.Equal(t, deviceStatusRunning, underTest.DeviceStatus(keptID.Hex()))
+	assert.Equal(t, tickerState{Running: true, PausedDevices: []string{stoppedID.Hex()}}, store.state)
+}
+
+func TestTickerService_StartDevice_ResumesPausedDevice(t *testing.T) {
+	id := primitive.NewObjectID()
+	device := Device{ID: id, Interval: Interval(time.Second), Value: 5}
+	measurements := make(chan Measurement)
+	triggers := make(chan chan time.Time, 2)
+
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &inMemoryDeviceDAO{devices: []Device{device}}},
+		publisher: func(m Measurement) error { measurements <- m; return nil },
+		tf:        newRecordingTickerFactory(triggers),
+		store:     &inMemoryTickerStateStore{state: tickerState{Running: true, PausedDevices: []string{id.Hex()}}},
+	}
+	defer underTest.Stop()
+
+	require.NoError(t, underTest.Restore(context.Background()))
+	assert.Equal(t, deviceStatusPaused, underTest.DeviceStatus(id.Hex()))
+
+	underTest.StartDevice(device)
+	trigger := <-triggers
+	trigger <- time.Time{}
+	result := <-measurements
+
+	assert.Equal(t, id.Hex(), result.Id)
+	assert.Equal(t, deviceStatusRunning, underTest.DeviceStatus(id.Hex()))
+}
+
+func TestTickerService_DeviceStatus_StoppedWhenTickersNotStarted(t *testing.T) {
+	underTest := TickerService{}
+
+	assert.Equal(t, deviceStatusStopped, underTest.DeviceStatus(primitive.NewObjectID().Hex()))
+}
+
+func TestTickerService_DeviceStatus_StoppedWhenGeneratorFails(t *testing.T) {
+	id := primitive.NewObjectID()
+	device := Device{ID: id, Interval: Interval(time.Second), Generator: &GeneratorConfig{Type: generatorReplay, File: "values.csv"}}
+	dao := inMemoryDeviceDAO{devices: []Device{device}}
+
+	underTest := TickerService{
+		ds:        &DeviceService{dao: &dao},
+		publisher: func(m Measurement) error { return nil },
+		tf:        func(d time.Duration) (<-chan time.Time, func()) { return nil, func() {} },
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	status := underTest.DeviceTickerStatus(id.Hex())
+
+	assert.Equal(t, deviceStatusStopped, status.Status)
+	assert.Equal(t, "replay "+errReplayDisabled.Error(), status.LastError)
+}
+
+func TestTickerService_DeviceTickerStatus_TracksPublishes(t *testing.T) {
+	id := primitive.NewObjectID()
+	dao := inMemoryDeviceDAO{devices: []Device{{ID: id, Interval: Interval(time.Second), Value: 5}}}
+	measurements := make(chan Measurement)
+	sendTrigger := make(chan time.Time)
+	firstTick := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	underTest := TickerService{
+		ds: &DeviceService{dao: &dao},
+		publisher: func(m Measurement) error {
+			measurements <- m
+			if m.Seq == 2 {
+				return errors.New("mock error - broker unavailable")
+			}
+			return nil
+		},
+		tf: func(d time.Duration) (<-chan time.Time, func()) { return sendTrigger, func() {} },
+	}
+	defer underTest.Stop()
+
+	_ = underTest.Start(context.Background())
+	sendTrigger <- firstTick
+	<-measurements
+	sendTrigger <- firstTick.Add(time.Second)
+	<-measurements
+
+	expectedNextTick := firstTick.Add(2 * time.Second)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(DeviceTickerStatus{
+			DeviceID:        id.Hex(),
+			Status:          deviceStatusRunning,
+			LastPublishedAt: &firstTick,
+			PublishCount:    1,
+			LastError:       "mock error - broker unavailable",
+			NextTickAt:      &expectedNextTick,
+		}, underTest.DeviceTickerStatus(id.Hex()))
+	}, time.Second, 5*time.Millisecond)
+
+	status := underTest.Status()
+	assert.True(t, status.Running)
+	assert.NotNil(t, status.StartedAt)
+	assert.Len(t, status.Devices, 1)
+}
+
+func newRecordingTickerFactory(triggers chan<- chan time.Time) tickerFactory {
+	return func(d time.Duration) (<-chan time.Time, func()) {
+		trigger := make(chan time.Time)
+		triggers <- trigger
+		return trigger, func() {}
+	}
+}
+
+func assertTriggerNotConsumed(t *testing.T, trigger chan<- time.Time) {
+	select {
+	case trigger <- time.Time{}:
+		assert.Fail(t, "stopped ticker should not consume ticks")
+	case <-time.After(50 * time.Millisecond):
+	}
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	generatorConstant   = "constant"
+	generatorRandomWalk = "random-walk"
+	generatorSine       = "sine"
+	generatorUniform    = "uniform"
+	generatorNormal     = "normal"
+	generatorStep       = "step"
+	generatorSawtooth   = "sawtooth"
+	generatorReplay     = "replay"
+)
+
+// GeneratorConfig selects how the values published for a device are produced.
+// Periods are given in seconds. Device.Value is used as the starting point or
+// offset where a generator needs one:
+//   - constant: always Device.Value
+//   - random-walk: starts at Device.Value and moves by at most "step" per tick,
+//     optionally clamped to "min" and "max"
+//   - sine: Device.Value + "amplitude" * sin(2π t / "period" + "phase")
+//   - uniform: uniformly distributed in ["min", "max")
+//   - normal: normally distributed around "mean" (Device.Value by default) with "stddev"
+//   - step: square wave switching between "low" (Device.Value by default) and
+//     "high" every half "period"
+//   - sawtooth: rises linearly from "min" to "max" over "period"
+//   - replay: replays the last column of the CSV file named by File,
+//     cyclically. The file has to be in the directory set by TSM_REPLAY_DIR
+type GeneratorConfig struct {
+	Type   string             `json:"type" bson:"type"`
+	Params map[string]float64 `json:"params,omitempty" bson:"params,omitempty"`
+	File   string             `json:"file,omitempty" bson:"file,omitempty"`
+}
+
+type ValueGenerator interface {
+	Next(t time.Time) float64
+}
+
+func newValueGenerator(device Device, replay *replayStore) (ValueGenerator, error) {
+	config := device.Generator
+	if config == nil || config.Type == "" || config.Type == generatorConstant {
+		return constantGenerator{value: device.Value}, nil
+	}
+
+	params := generatorParams(config.Params)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	switch config.Type {
+	case generatorRandomWalk:
+		step := params.getOrDefault("step", 1)
+		min, hasMin := params["min"]
+		max, hasMax := params["max"]
+		if step <= 0 {
+			return nil, errors.New("random-walk step has to be greater than 0")
+		}
+		if !hasMin {
+			min = math.Inf(-1)
+		}
+		if !hasMax {
+			max = math.Inf(1)
+		}
+		if min > max || device.Value < min || device.Value > max {
+			return nil, errors.New("random-walk value has to be between min and max")
+		}
+		return &randomWalkGenerator{value: device.Value, step: step, min: min, max: max, rnd: rnd}, nil
+	case generatorSine:
+		period := params.getOrDefault("period", 0)
+		if period <= 0 {
+			return nil, errors.New("sine period has to be greater than 0")
+		}
+		return sineGenerator{
+			offset:    device.Value,
+			amplitude: params.getOrDefault("amplitude", 1),
+			period:    period,
+			phase:     params.getOrDefault("phase", 0),
+		}, nil
+	case generatorUniform:
+		min, max, err := params.getRange()
+		if err != nil {
+			return nil, fmt.Errorf("uniform %w", err)
+		}
+		return uniformGenerator{min: min, max: max, rnd: rnd}, nil
+	case generatorNormal:
+		stddev := params.getOrDefault("stddev", 0)
+		if stddev <= 0 {
+			return nil, errors.New("normal stddev has to be greater than 0")
+		}
+		return normalGenerator{mean: params.getOrDefault("mean", device.Value), stddev: stddev, rnd: rnd}, nil
+	case generatorStep:
+		period := params.getOrDefault("period", 0)
+		if period <= 0 {
+			return nil, errors.New("step period has to be greater than 0")
+		}
+		high, ok := params["high"]
+		if !ok {
+			return nil, errors.New("step requires high")
+		}
+		return stepGenerator{low: params.getOrDefault("low", device.Value), high: high, period: period}, nil
+	case generatorSawtooth:
+		min, max, err := params.getRange()
+		if err != nil {
+			return nil, fmt.Errorf("sawtooth %w", err)
+		}
+		period := params.getOrDefault("period", 0)
+		if period <= 0 {
+			return nil, errors.New("sawtooth period has to be greater than 0")
+		}
+		return sawtoothGenerator{min: min, max: max, period: period}, nil
+	case generatorReplay:
+		values, err := replay.values(config.File)
+		if err != nil {
+			return nil, fmt.Errorf("replay %w", err)
+		}
+		return &replayGenerator{values: values}, nil
+	default:
+		return nil, fmt.Errorf("unknown generator type %q", config.Type)
+	}
+}
+
+type generatorParams map[string]float64
+
+func (p generatorParams) getOrDefault(name string, defVal float64) float64 {
+	if value, ok := p[name]; ok {
+		return value
+	}
+
+	return defVal
+}
+
+func (p generatorParams) getRange() (float64, float64, error) {
+	min, hasMin := p["min"]
+	max, hasMax := p["max"]
+	if !hasMin || !hasMax || min >= max {
+		return 0, 0, errors.New("requires min lower than max")
+	}
+
+	return min, max, nil
+}
+
+type constantGenerator struct {
+	value float64
+}
+
+func (g constantGenerator) Next(_ time.Time) float64 {
+	return g.value
+}
+
+type randomWalkGenerator struct {
+	value float64
+	step  float64
+	min   float64
+	max   float64
+	rnd   *rand.Rand
+}
+
+func (g *randomWalkGenerator) Next(_ time.Time) float64 {
+	current := g.value
+	g.value = math.Max(g.min, math.Min(g.max, g.value+(g.rnd.Float64()*2-1)*g.step))
+
+	return current
+}
+
+type sineGenerator struct {
+	offset    float64
+	amplitude float64
+	period    float64
+	phase     float64
+}
+
+func (g sineGenerator) Next(t time.Time) float64 {
+	return g.offset + g.amplitude*math.Sin(2*math.Pi*secondsSinceEpoch(t)/g.period+g.phase)
+}
+
+type uniformGenerator struct {
+	min float64
+	max float64
+	rnd *rand.Rand
+}
+
+func (g uniformGenerator) Next(_ time.Time) float64 {
+	return g.min + g.rnd.Float64()*(g.max-g.min)
+}
+
+type normalGenerator struct {
+	mean   float64
+	stddev float64
+	rnd    *rand.Rand
+}
+
+func (g normalGenerator) Next(_ time.Time) float64 {
+	return g.mean + g.rnd.NormFloat64()*g.stddev
+}
+
+type stepGenerator struct {
+	low    float64
+	high   float64
+	period float64
+}
+
+func (g stepGenerator) Next(t time.Time) float64 {
+	if periodFraction(t, g.period) < 0.5 {
+		return g.low
+	}
+
+	return g.high
+}
+
+type sawtoothGenerator struct {
+	min    float64
+	max    float64
+	period float64
+}
+
+func (g sawtoothGenerator) Next(t time.Time) float64 {
+	return g.min + (g.max-g.min)*periodFraction(t, g.period)
+}
+
+type replayGenerator struct {
+	values []float64
+	next   int
+}
+
+func (g *replayGenerator) Next(_ time.Time) float64 {
+	value := g.values[g.next]
+	g.next = (g.next + 1) % len(g.values)
+
+	return value
+}
+
+func secondsSinceEpoch(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func periodFraction(t time.Time, period float64) float64 {
+	fraction := math.Mod(secondsSinceEpoch(t), period) / period
+	if fraction < 0 {
+		fraction++
+	}
+
+	return fraction
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var epoch = time.Unix(0, 0)
+
+func TestNewValueGenerator_DeterministicGenerators(t *testing.T) {
+	testCases := map[string]struct {
+		device   Device
+		times    []time.Time
+		expected []float64
+	}{
+		"no generator is constant": {
+			device:   Device{Value: 5},
+			times:    []time.Time{epoch, epoch.Add(time.Hour)},
+			expected: []float64{5, 5},
+		},
+		"sine": {
+			device:   Device{Value: 10, Generator: &GeneratorConfig{Type: generatorSine, Params: map[string]float64{"amplitude": 2, "period": 4}}},
+			times:    []time.Time{epoch, epoch.Add(time.Second), epoch.Add(3 * time.Second)},
+			expected: []float64{10, 12, 8},
+		},
+		"step": {
+			device:   Device{Value: 1, Generator: &GeneratorConfig{Type: generatorStep, Params: map[string]float64{"high": 3, "period": 10}}},
+			times:    []time.Time{epoch, epoch.Add(4 * time.Second), epoch.Add(5 * time.Second), epoch.Add(10 * time.Second)},
+			expected: []float64{1, 1, 3, 1},
+		},
+		"sawtooth": {
+			device:   Device{Generator: &GeneratorConfig{Type: generatorSawtooth, Params: map[string]float64{"min": 0, "max": 8, "period": 4}}},
+			times:    []time.Time{epoch, epoch.Add(time.Second), epoch.Add(3 * time.Second), epoch.Add(4 * time.Second)},
+			expected: []float64{0, 2, 6, 0},
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			underTest, err := newValueGenerator(testCase.device, nil)
+			require.NoError(t, err)
+
+			for i, tick := range testCase.times {
+				assert.InDelta(t, testCase.expected[i], underTest.Next(tick), 1e-9)
+			}
+		})
+	}
+}
+
+func TestRandomWalkGenerator_StaysWithinBoundsAndStep(t *testing.T) {
+	underTest := randomWalkGenerator{value: 0, step: 1, min: -2, max: 2, rnd: rand.New(rand.NewSource(1))}
+
+	previous := underTest.Next(epoch)
+	for i := 0; i < 1000; i++ {
+		value := underTest.Next(epoch)
+		assert.InDelta(t, previous, value, 1)
+		assert.True(t, value >= -2 && value <= 2)
+		previous = value
+	}
+}
+
+func TestUniformGenerator_StaysWithinRange(t *testing.T) {
+	underTest := uniformGenerator{min: 3, max: 4, rnd: rand.New(rand.NewSource(1))}
+
+	for i := 0; i < 1000; i++ {
+		value := underTest.Next(epoch)
+		assert.True(t, value >= 3 && value < 4)
+	}
+}
+
+func TestReplayGenerator_ReplaysCSVCyclically(t *testing.T) {
+	dir := writeReplayFile(t, "values.csv", "time,value\n2021-01-01T00:00:00Z,1.5\n2021-01-01T00:00:01Z,2.5\n")
+	device := Device{Generator: &GeneratorConfig{Type: generatorReplay, File: "values.csv"}}
+
+	underTest, err := newValueGenerator(device, newReplayStore(dir))
+	require.NoError(t, err)
+
+	assert.Equal(t, []float64{1.5, 2.5, 1.5}, []float64{underTest.Next(epoch), underTest.Next(epoch), underTest.Next(epoch)})
+}
+
+func TestNewValueGenerator_InvalidConfigs(t *testing.T) {
+	testCases := map[string]GeneratorConfig{
+		"unknown type":                     {Type: "square"},
+		"random-walk zero step":            {Type: generatorRandomWalk, Params: map[string]float64{"step": 0}},
+		"random-walk value outside bounds": {Type: generatorRandomWalk, Params: map[string]float64{"min": 10, "max": 20}},
+		"sine without period":              {Type: generatorSine},
+		"uniform without max":              {Type: generatorUniform, Params: map[string]float64{"min": 1}},
+		"uniform min above max":            {Type: generatorUniform, Params: map[string]float64{"min": 2, "max": 1}},
+		"normal without stddev":            {Type: generatorNormal},
+		"step without high":                {Type: generatorStep, Params: map[string]float64{"period": 1}},
+		"sawtooth without period":          {Type: generatorSawtooth, Params: map[string]float64{"min": 0, "max": 1}},
+		"replay without file":              {Type: generatorReplay},
+		"replay missing file":              {Type: generatorReplay, File: "tsm-does-not-exist.csv"},
+	}
+
+	for name, config := range testCases {
+		t.Run(name, func(t *testing.T) {
+			config := config
+			_, err := newValueGenerator(Device{Value: 0, Generator: &config}, newReplayStore(os.TempDir()))
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func writeReplayFile(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "tsm-replay-")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+
+	return dir
+}